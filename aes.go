@@ -0,0 +1,139 @@
+package zip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// aesExtra is the WinZip AES extra field of an encrypted file.
+type aesExtra struct {
+	version  uint16 // AE_1 or AE_2
+	strength byte   // 1, 2, or 3 for AES-128, AES-192, or AES-256
+	method   uint16 // compression method of the data before it was encrypted
+}
+
+// aesExtra returns the file's WinZip AES extra field, if it has one.
+func (fh *fileHeader) aesExtra() (aesExtra, bool) {
+	data, ok := extraField(fh.extra, EXTRA_AES)
+	if !ok || len(data) < 7 || string(data[2:4]) != "AE" {
+		return aesExtra{}, false
+	}
+	return aesExtra{
+		version:  binary.LittleEndian.Uint16(data[0:2]),
+		strength: data[4],
+		method:   binary.LittleEndian.Uint16(data[5:7]),
+	}, true
+}
+
+// crcMatches returns whether crc is the CRC of the file's data. AE-2 files store 0
+// instead of their CRC (the authentication code checks the data instead), so any crc
+// matches.
+func (fh *fileHeader) crcMatches(crc uint32) bool {
+	if fh.compressionMethod == COMPRESS_AES {
+		extra, ok := fh.aesExtra()
+		if ok && extra.version == AE_2 {
+			return true
+		}
+	}
+	return crc == fh.crc
+}
+
+// aesReader decrypts the data of a WinZip AES file, and checks its authentication
+// code at the end of the data.
+type aesReader struct {
+	r       io.Reader // the encrypted data, not including the authentication code
+	data    io.Reader // everything after the password verifier, for reading the authentication code
+	stream  cipher.Stream
+	mac     hash.Hash
+	checked bool
+}
+
+// newAESReader returns a reader for the decrypted data of fh, whose encrypted data
+// (including the salt, password verifier, and authentication code) is read from
+// fileData. It returns ErrBadPassword if password isn't the file's password.
+func newAESReader(fh *fileHeader, extra aesExtra, fileData io.Reader, password string) (io.Reader, error) {
+	if extra.strength < 1 || extra.strength > 3 {
+		return nil, fmt.Errorf("unsupported AES strength %d for entry %q", extra.strength, fh.fileName)
+	}
+	keyLen := 8 + 8*int(extra.strength)
+	saltLen := keyLen / 2
+	dataLen := int64(fh.compressedSize) - int64(saltLen) - AES_VERIFIER_LEN - AES_AUTH_CODE_LEN
+	if dataLen < 0 {
+		return nil, fmt.Errorf("AES data is too short for entry %q", fh.fileName)
+	}
+
+	header := make([]byte, saltLen+AES_VERIFIER_LEN)
+	_, err := io.ReadFull(fileData, header)
+	if err != nil {
+		return nil, err
+	}
+	salt, verifier := header[:saltLen], header[saltLen:]
+	keys := pbkdf2.Key([]byte(password), salt, AES_ITERATIONS, 2*keyLen+AES_VERIFIER_LEN, sha1.New)
+	if !hmac.Equal(keys[2*keyLen:], verifier) {
+		return nil, fmt.Errorf("%w for entry %q", ErrBadPassword, fh.fileName)
+	}
+
+	block, err := aes.NewCipher(keys[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	return &aesReader{
+		r:      io.LimitReader(fileData, dataLen),
+		data:   fileData,
+		stream: &winZipCTR{block: block, counter: make([]byte, aes.BlockSize), keystream: make([]byte, aes.BlockSize), used: aes.BlockSize},
+		mac:    hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+	}, nil
+}
+
+func (ar *aesReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	ar.mac.Write(p[:n])
+	ar.stream.XORKeyStream(p[:n], p[:n])
+	if err == io.EOF && !ar.checked {
+		ar.checked = true
+		authCode := make([]byte, AES_AUTH_CODE_LEN)
+		_, err := io.ReadFull(ar.data, authCode)
+		if err != nil {
+			return n, err
+		}
+		if !hmac.Equal(ar.mac.Sum(nil)[:AES_AUTH_CODE_LEN], authCode) {
+			return n, errors.New("AES authentication code mismatch")
+		}
+	}
+	return n, err
+}
+
+// winZipCTR is AES in counter mode the way WinZip does it, with a little-endian
+// counter that starts at 1. (cipher.NewCTR's counter is big-endian.)
+type winZipCTR struct {
+	block     cipher.Block
+	counter   []byte
+	keystream []byte
+	used      int // bytes of keystream used so far
+}
+
+func (c *winZipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == len(c.keystream) {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.keystream, c.counter)
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.keystream[c.used]
+		c.used++
+	}
+}
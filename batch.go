@@ -0,0 +1,273 @@
+package zip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Batch queues changes to an archive so that they're all written with a single
+// rewrite when Commit is called. Nothing is written to disk before then. Don't
+// change the File through its own methods while a Batch is in use, since Commit
+// replaces the archive's contents with the Batch's.
+type Batch struct {
+	zf      *File
+	headers []fileHeader // the archive's file headers, with the queued changes applied
+}
+
+// Batch returns a new Batch for queuing changes to the archive.
+func (zf *File) Batch() *Batch {
+	return &Batch{zf: zf, headers: slices.Clone(zf.fileHeaders)}
+}
+
+// AddFile queues adding the file with the given name to the archive, replacing any
+// file in the archive with the same name. The file is read again when Commit is
+// called, which returns ErrFileChanged if it no longer matches what AddFile read.
+func (b *Batch) AddFile(name string, method CompressionMethod) error {
+	fh, err := b.zf.newFileHeader(name, name, method)
+	if err != nil {
+		return err
+	}
+	b.put(fh)
+	return nil
+}
+
+// AddFileStrict is like AddFile, but it returns ErrDuplicateName instead of replacing
+// a file in the archive (or one already queued) with the same name.
+func (b *Batch) AddFileStrict(name string, method CompressionMethod) error {
+	fh, err := b.zf.newFileHeader(name, name, method)
+	if err != nil {
+		return err
+	}
+	if b.find(fh.fileName) >= 0 {
+		return newZipError("AddFileStrict", fmt.Errorf("%w: %q", ErrDuplicateName, fh.fileName))
+	}
+	b.put(fh)
+	return nil
+}
+
+// AddFileAs queues adding the file at sourcePath to the archive as a file named
+// entryName, replacing any file in the archive with that name.
+func (b *Batch) AddFileAs(sourcePath string, entryName string, method CompressionMethod) error {
+	fh, err := b.zf.newFileHeader(sourcePath, entryName, method)
+	if err != nil {
+		return err
+	}
+	b.put(fh)
+	return nil
+}
+
+// AddFileWithOptions is like AddFile, but the file is stored as opts says.
+func (b *Batch) AddFileWithOptions(name string, opts AddOptions) error {
+	err := checkLevel("AddFile", opts.Level)
+	if err != nil {
+		return err
+	}
+	fh, err := b.zf.newFileHeader(name, name, opts.Method)
+	if err != nil {
+		return err
+	}
+	fh.level = opts.flateLevel()
+	b.put(fh)
+	return nil
+}
+
+// AddFileWithTime is like AddFile, but the file is stored with the modification time
+// modTime instead of the time it was last modified on disk.
+func (b *Batch) AddFileWithTime(name string, method CompressionMethod, modTime time.Time) error {
+	fh, err := b.zf.newFileHeader(name, name, method)
+	if err != nil {
+		return err
+	}
+	fh.dosDate, fh.dosTime = timeToDosDateTime(modTime.In(b.zf.timeLocation()))
+	b.put(fh)
+	return nil
+}
+
+// AddReader queues adding the data read from r to the archive as a file with the
+// given name, replacing any file in the archive with the same name. r is read
+// (and buffered in memory) right away.
+func (b *Batch) AddReader(name string, r io.Reader, method CompressionMethod) error {
+	fh, err := b.zf.newReaderHeader(name, r, method)
+	if err != nil {
+		return err
+	}
+	b.put(fh)
+	return nil
+}
+
+// AddDir queues adding the directory tree rooted at root to the archive, with the same
+// names as File.AddDir gives them.
+func (b *Batch) AddDir(root string, method CompressionMethod) error {
+	return b.AddDirAs(root, "", method)
+}
+
+// AddDirAs is like AddDir, but the tree is stored under the directory name (cleaned up
+// like AddFile's names), which gets an entry of its own. So AddDirAs("src", "docs", ...)
+// stores src/a.txt as "docs/a.txt". An empty name stores the tree like AddDir.
+func (b *Batch) AddDirAs(root string, name string, method CompressionMethod) error {
+	err := checkWriteMethod("AddDir", method)
+	if err != nil {
+		return err
+	}
+	prefix := ""
+	if name != "" {
+		prefix, err = entryName(name)
+		if err != nil {
+			return newZipError("AddDir", err)
+		}
+		prefix = strings.TrimSuffix(prefix, "/")
+	}
+
+	return afero.Walk(b.zf.fs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := prefix
+		if rel == "." {
+			if prefix == "" {
+				return nil // root itself only gets an entry if it has a name
+			}
+		} else if prefix == "" {
+			name = filepath.ToSlash(rel)
+		} else {
+			name = prefix + "/" + filepath.ToSlash(rel)
+		}
+
+		if info.IsDir() {
+			// Every directory gets an entry, so that empty ones are extracted too
+			fh := newDirHeader(name+"/", info.ModTime().In(b.zf.timeLocation()))
+			fh.setUnixMode(S_IFDIR, info.Mode())
+			b.put(fh)
+		} else if info.Mode().IsRegular() {
+			fh, err := b.zf.newFileHeader(path, name, method)
+			if err != nil {
+				return err
+			}
+			b.put(fh)
+		}
+		// Anything else (symlinks, devices, etc.) is skipped.
+		return nil
+	})
+}
+
+// CopyEntryFrom queues copying the file with the given name from src into the archive,
+// replacing any file in the archive with the same name. src must stay open until
+// Commit is called. It returns ErrFileNotFound if src doesn't have the file.
+func (b *Batch) CopyEntryFrom(src *File, name string) error {
+	i := src.findFileHeader(name)
+	if i < 0 {
+		return newZipError("CopyEntryFrom", ErrFileNotFound)
+	}
+	b.put(src.copiedHeader(&src.fileHeaders[i]))
+	return nil
+}
+
+// UpdateFile queues replacing the contents of the file with the given name with the
+// data read from r, keeping its place in the archive and its comment. r is read (and
+// buffered in memory) right away. It returns ErrFileNotFound if the archive doesn't
+// have the file.
+func (b *Batch) UpdateFile(name string, r io.Reader, method CompressionMethod) error {
+	i := b.find(name)
+	if i < 0 {
+		return newZipError("UpdateFile", ErrFileNotFound)
+	}
+	fh, err := b.zf.newReaderHeader(name, r, method)
+	if err != nil {
+		return err
+	}
+	fh.comment = b.headers[i].comment
+	fh.commentLength = b.headers[i].commentLength
+	b.headers[i] = fh
+	return nil
+}
+
+// RenameEntry queues renaming the file named oldName to newName, which is cleaned up
+// like AddFile's names. It returns ErrFileNotFound if the archive doesn't have oldName,
+// ErrInsecurePath if newName would be outside the archive, or ErrDuplicateName if the
+// archive already has newName.
+func (b *Batch) RenameEntry(oldName string, newName string) error {
+	i := b.find(oldName)
+	if i < 0 {
+		return newZipError("RenameEntry", ErrFileNotFound)
+	}
+	newName, err := entryName(newName)
+	if err != nil {
+		return newZipError("RenameEntry", err)
+	}
+	if j := b.find(newName); j >= 0 && j != i {
+		return newZipError("RenameEntry", ErrDuplicateName)
+	}
+	// nameLength is left alone: it's still the length of the name in the archive, which
+	// we need to find the data. It's updated when the archive is written.
+	b.headers[i].fileName = newName
+	return nil
+}
+
+// RemoveFile queues removing the file with the given name from the archive. It
+// returns ErrFileNotFound if the archive doesn't have the file.
+func (b *Batch) RemoveFile(name string) error {
+	if !b.remove(name) {
+		return newZipError("RemoveFile", ErrFileNotFound)
+	}
+	return nil
+}
+
+// SetFileComment queues setting the comment on the file with the given name.
+func (b *Batch) SetFileComment(name string, comment string) error {
+	return setFileComment(b.headers, b.find(name), comment)
+}
+
+// Commit rewrites the archive with all of the queued changes. The archive is
+// written to a temp file that replaces the original, so if Commit fails, the
+// original archive is left intact.
+func (b *Batch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext is like Commit, but it stops with ctx's error if ctx is done before the
+// archive is rewritten. The original archive is left intact.
+func (b *Batch) CommitContext(ctx context.Context) error {
+	return b.zf.rewriteArchive(ctx, b.headers)
+}
+
+// put adds fh to the batch's file headers. It replaces any existing file header with
+// the same name in place, so that the archive's order doesn't change.
+func (b *Batch) put(fh fileHeader) {
+	i := b.find(fh.fileName)
+	if i >= 0 {
+		b.headers[i] = fh
+		return
+	}
+	b.headers = append(b.headers, fh)
+}
+
+// remove removes the file header with the given name from the batch's file headers,
+// and returns whether it was there.
+func (b *Batch) remove(name string) bool {
+	i := b.find(name)
+	if i < 0 {
+		return false
+	}
+	b.headers = slices.Delete(b.headers, i, i+1)
+	return true
+}
+
+// find returns the index in the batch's file headers of the file with the given
+// name, or -1 if there isn't one.
+func (b *Batch) find(name string) int {
+	return slices.IndexFunc(b.headers, func(fh fileHeader) bool {
+		return fh.fileName == name
+	})
+}
@@ -0,0 +1,202 @@
+package zip
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestBatch(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+		{"fileThree.txt", "", []byte("File number 3")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	makeTestFile(fs, "fileFour.txt", []byte("File number 4"))
+	makeTestFile(fs, "fileFive.txt", []byte("File number 5"))
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+
+	b := zf.Batch()
+	steps := []struct {
+		name string
+		err  error
+	}{
+		{"AddFile", b.AddFile("fileFour.txt", COMPRESS_STORED)},
+		{"AddFile", b.AddFile("fileFive.txt", COMPRESS_STORED)},
+		{"AddReader", b.AddReader("fileSix.txt", bytes.NewReader([]byte("File number 6")), COMPRESS_STORED)},
+		{"RemoveFile", b.RemoveFile(files[0].name)},
+		{"RemoveFile", b.RemoveFile(files[2].name)},
+		{"SetFileComment", b.SetFileComment(files[1].name, "retagged")},
+	}
+	for _, step := range steps {
+		if step.err != nil {
+			t.Fatalf("%s returned error: %v", step.name, step.err)
+		}
+	}
+
+	// Nothing is written until Commit
+	err = verifyZipFile(t, fs, zipFileName, "", files)
+	if err != nil {
+		t.Errorf("verifyZipFile returned error: %v", err)
+	}
+
+	err = b.Commit()
+	if err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	err = verifyZipFile(t, fs, zipFileName, "", []testfile{
+		{"filebeta.txt", "retagged", []byte("Second file in the archive.")},
+		{"fileFour.txt", "", []byte("File number 4")},
+		{"fileFive.txt", "", []byte("File number 5")},
+		{"fileSix.txt", "", []byte("File number 6")},
+	})
+	if err != nil {
+		t.Errorf("verifyZipFile returned error: %v", err)
+	}
+}
+
+func TestBatchCommitFailure(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	makeTestFile(fs, "fileTwo.txt", []byte("File number 2"))
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+
+	b := zf.Batch()
+	err = b.RemoveFile(files[0].name)
+	if err != nil {
+		t.Fatalf("RemoveFile returned error: %v", err)
+	}
+	err = b.AddFile("fileTwo.txt", COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddFile returned error: %v", err)
+	}
+
+	// The file to add disappears before the batch is committed
+	err = fs.Remove("fileTwo.txt")
+	if err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+	err = b.Commit()
+	if err == nil {
+		t.Errorf("Commit should have failed, but didn't")
+	}
+	if len(zf.List()) != 1 {
+		t.Errorf("zf.List() has %d entries after a failed Commit; Want: 1", len(zf.List()))
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	err = verifyZipFile(t, fs, zipFileName, "", files)
+	if err != nil {
+		t.Errorf("verifyZipFile returned error: %v", err)
+	}
+}
+
+func TestBatchFileChanged(t *testing.T) {
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	var testcases = []struct {
+		name    string
+		method  CompressionMethod
+		changed []byte
+	}{
+		{"SameSize", COMPRESS_STORED, []byte("File number X")},
+		{"Longer", COMPRESS_STORED, []byte("File number 2, and then some")},
+		{"Shorter", COMPRESS_DEFLATED, []byte("File")},
+	}
+	for _, c := range testcases {
+		fs := afero.NewMemMapFs()
+		zipFileName := "testArchive.zip"
+		makeZipFile(t, fs, zipFileName, "", files)
+		makeTestFile(fs, "fileTwo.txt", []byte("File number 2"))
+
+		zf, err := OpenWithFs(zipFileName, fs)
+		if err != nil {
+			t.Fatalf("OpenWithFs returned error: %v", err)
+		}
+		b := zf.Batch()
+		err = b.AddFile("fileTwo.txt", c.method)
+		if err != nil {
+			t.Fatalf("AddFile returned error: %v", err)
+		}
+
+		// The file to add is edited before the batch is committed
+		makeTestFile(fs, "fileTwo.txt", c.changed)
+		err = b.Commit()
+		if !errors.Is(err, ErrFileChanged) {
+			t.Errorf("%s: Commit returned %v; Want: %v", c.name, err, ErrFileChanged)
+		}
+		zf.Close()
+		err = verifyZipFile(t, fs, zipFileName, "", files)
+		if err != nil {
+			t.Errorf("%s: verifyZipFile returned error: %v", c.name, err)
+		}
+	}
+}
+
+func TestBatchAddDirAs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	err := fs.MkdirAll("tree/empty", 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll returned error: %v", err)
+	}
+	makeTestFile(fs, "tree/a.txt", []byte("File a"))
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	b := zf.Batch()
+	err = b.AddDirAs("tree", "./docs/", COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddDirAs returned error: %v", err)
+	}
+	err = b.AddDirAs("tree", "../docs", COMPRESS_STORED)
+	if !errors.Is(err, ErrInsecurePath) {
+		t.Errorf("AddDirAs with an insecure name returned %v; Want: %v", err, ErrInsecurePath)
+	}
+	err = b.Commit()
+	if err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+	zf.Close()
+
+	err = verifyZipFile(t, fs, zipFileName, "", append(files,
+		testfile{"docs/", "", []byte{}},
+		testfile{"docs/a.txt", "", []byte("File a")},
+		testfile{"docs/empty/", "", []byte{}},
+	))
+	if err != nil {
+		t.Errorf("verifyZipFile returned error: %v", err)
+	}
+}
@@ -5,30 +5,56 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
 
 	"github.com/ASchurman/zip"
+	"github.com/spf13/afero"
+)
+
+// Exit codes
+const (
+	EXIT_OK    = 0
+	EXIT_ERROR = 1 // the operation failed
+	EXIT_USAGE = 2 // the command line was invalid
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run does the operation given on the command line and returns the exit code. It's
+// separate from main so that deferred calls run before os.Exit.
+func run() int {
 	optTable := flag.Bool("t", false, "display table of contents")
 	optExtract := flag.Bool("x", false, "extract a file (or, if no file is specified, extract all files)")
-	optAdd := flag.Bool("r", false, "add a file to the zip file")
+	optAdd := flag.Bool("r", false, "add files to the zip file, including everything under any directories")
 	optDelete := flag.Bool("d", false, "delete a file from the zip file")
-	flag.Parse()
-	args := flag.Args()
+	optTest := flag.Bool("T", false, "test the integrity of every file in the zip file")
+	optComment := flag.Bool("c", false, "set the archive comment")
+	optVerbose := flag.Bool("v", false, "with -t, also show each file's comment")
+	optOutput := flag.String("o", "", "extract into this directory instead of the current one")
+	args := parseArgs()
 
-	if len(args) == 0 || flag.NFlag() != 1 {
-		fmt.Println("Usage: zip {-d|-r|-t|-x} ARCHIVE [FILE ...]")
-		return
+	numOps := 0
+	for _, op := range []bool{*optTable, *optTest, *optExtract, *optAdd, *optDelete, *optComment} {
+		if op {
+			numOps++
+		}
+	}
+	if len(args) == 0 || numOps != 1 || (*optOutput != "" && !*optExtract) || (*optVerbose && !*optTable) || (*optComment && len(args) != 2) {
+		fmt.Fprintln(os.Stderr, "Usage: zip {-d|-r|-t [-v]|-T|-x [-o DIR]} ARCHIVE [FILE ...]")
+		fmt.Fprintln(os.Stderr, "       zip -c ARCHIVE COMMENT")
+		return EXIT_USAGE
 	}
 
 	// Open zip file
 	zf, err := zip.Open(args[0])
 	if err != nil {
-		// Don't panic if we're adding a file and the archive doesn't exist.
+		// It's not an error if we're adding a file and the archive doesn't exist.
 		// In that case, we're creating a new archive.
 		if !*optAdd || !errors.Is(err, os.ErrNotExist) {
-			panic(err)
+			return fail(err)
 		}
 	} else {
 		defer zf.Close()
@@ -36,36 +62,182 @@ func main() {
 
 	// Do the desired operation
 	if *optTable {
-		zf.Display(os.Stdout)
+		if *optVerbose {
+			zf.DisplayComments(os.Stdout)
+		} else {
+			zf.Display(os.Stdout)
+		}
+	} else if *optTest {
+		return test(zf)
 	} else if *optExtract {
 		if len(args) > 1 {
-			for _, arg := range args[1:] {
-				panicOnError(zf.ExtractFile(arg))
+			names, err := matchNames(zf, args[1:])
+			if err != nil {
+				return fail(err)
+			}
+			for _, arg := range names {
+				if *optOutput != "" {
+					err = zf.ExtractFileTo(arg, *optOutput)
+				} else {
+					err = zf.ExtractFile(arg)
+				}
+				if err != nil {
+					return fail(err)
+				}
 			}
 		} else {
-			panicOnError(zf.ExtractAll())
+			if *optOutput != "" {
+				err = zf.ExtractAllTo(*optOutput)
+			} else {
+				err = zf.ExtractAll()
+			}
+			if err != nil {
+				return fail(err)
+			}
 		}
 	} else if *optAdd {
-		for _, arg := range args[1:] {
+		if len(args) == 1 {
 			if zf == nil {
-				zf, err = zip.Create(args[0], arg, zip.COMPRESS_STORED)
-				if err != nil {
-					panic(err)
-				}
-				defer zf.Close()
-			} else {
-				panicOnError(zf.AddFile(arg, zip.COMPRESS_STORED))
+				return fail(errors.New("no files to add"))
 			}
+			return EXIT_OK
+		}
+		if zf == nil {
+			zf, err = zip.CreateArchive(afero.NewOsFs(), args[0], zip.CreateOptions{})
+			if err != nil {
+				return fail(err)
+			}
+			defer zf.Close()
+		}
+
+		// Add everything at once, so the archive is only rewritten once
+		b := zf.Batch()
+		for _, path := range args[1:] {
+			err = addPath(b, path)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		err = b.Commit()
+		if err != nil {
+			return fail(err)
+		}
+	} else if *optComment {
+		err = zf.SetArchiveComment(args[1])
+		if err != nil {
+			return fail(err)
+		}
+		err = zf.Save()
+		if err != nil {
+			return fail(err)
 		}
 	} else if *optDelete {
 		for _, arg := range args[1:] {
-			panicOnError(zf.RemoveFile(arg))
+			err = zf.RemoveFile(arg)
+			if err != nil {
+				return fail(err)
+			}
 		}
 	}
+	return EXIT_OK
 }
 
-func panicOnError(err error) {
+// parseArgs parses the command-line flags and returns the other arguments. Unlike
+// flag.Parse, it allows flags after the archive name, as in "zip -x ARCHIVE -o DIR".
+// Everything after "--" is an argument.
+func parseArgs() []string {
+	input := os.Args[1:]
+	args := []string{}
+	for {
+		flag.CommandLine.Parse(input)
+		rest := flag.Args()
+		consumed := input[:len(input)-len(rest)]
+		if len(rest) == 0 || (len(consumed) > 0 && consumed[len(consumed)-1] == "--") {
+			return append(args, rest...)
+		}
+		args = append(args, rest[0])
+		input = rest[1:]
+	}
+}
+
+// test verifies every file in zf, printing whether each one is OK, and returns the exit
+// code: EXIT_ERROR if any file is corrupt.
+func test(zf *zip.File) int {
+	checked := 0
+	failed := 0
+	zf.VerifyEach(func(e zip.Entry, err error) {
+		checked++
+		if err != nil {
+			failed++
+			fmt.Printf("FAILED  %s: %v\n", e.Name, err)
+		} else {
+			fmt.Printf("    OK  %s\n", e.Name)
+		}
+	})
+	if failed > 0 {
+		fmt.Printf("%d of %d files failed in %s\n", failed, checked, zf.Name)
+		return EXIT_ERROR
+	}
+	fmt.Printf("No errors detected in %s (%d files)\n", zf.Name, checked)
+	return EXIT_OK
+}
+
+// matchNames returns the names of the files in zf to extract for the given arguments.
+// Each argument is either the name of a file, or a pattern for path.Match (like
+// "docs/*.md") that's matched against every file name. It's an error if an argument
+// doesn't match any files.
+func matchNames(zf *zip.File, args []string) ([]string, error) {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, arg := range args {
+		if zf.Contains(arg) {
+			if !seen[arg] {
+				seen[arg] = true
+				names = append(names, arg)
+			}
+			continue
+		}
+		matched := false
+		for _, name := range zf.Names() {
+			ok, err := path.Match(arg, name)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %w", arg, err)
+			}
+			if ok {
+				matched = true
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no files in the archive match %q", arg)
+		}
+	}
+	return names, nil
+}
+
+// addPath queues adding the file or directory at path to b. A directory is added with
+// everything under it, named by their paths from the directory as given (so
+// "zip -r ARCHIVE docs" adds "docs/", "docs/a.txt", "docs/b/c.txt", etc.).
+func addPath(b *zip.Batch, path string) error {
+	info, err := os.Stat(path)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if !info.IsDir() {
+		return b.AddFile(path, zip.COMPRESS_STORED)
 	}
+	name := filepath.Clean(path)
+	if name == "." {
+		name = "" // the current directory's contents go at the top of the archive
+	}
+	return b.AddDirAs(path, name, zip.COMPRESS_STORED)
+}
+
+// fail prints err to stderr and returns the exit code for a failed operation.
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "zip: %v\n", err)
+	return EXIT_ERROR
 }
@@ -0,0 +1,131 @@
+package zip
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// entryFile is an fs.File for reading a file in the archive.
+type entryFile struct {
+	fh  fileHeader
+	loc *time.Location // time zone of the file's DOS time
+	r   io.ReadCloser  // the decompressed data
+	crc hash.Hash32
+}
+
+// entryInfo is the fs.FileInfo for a file in the archive.
+type entryInfo struct {
+	fh  fileHeader
+	loc *time.Location // time zone of the file's DOS time
+}
+
+// OpenEntry opens the file with the given name in the archive for reading. Reading
+// returns the file's decompressed data, and returns an error at the end of the data if
+// the CRC doesn't match. Nothing is written to disk.
+func (zf *File) OpenEntry(name string) (fs.File, error) {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return nil, newZipError("OpenEntry", ErrFileNotFound)
+	}
+	fh := zf.fileHeaders[i]
+	fileData, err := zf.openFileData(&fh)
+	if err != nil {
+		return nil, newZipError("OpenEntry", err)
+	}
+	return &entryFile{fh: fh, loc: zf.timeLocation(), r: fileData, crc: crc32.NewIEEE()}, nil
+}
+
+// OpenReaderAt returns an io.ReaderAt for random access to the decompressed data of the
+// file with the given name in the archive, along with the data's size. A stored file is
+// read straight from the archive, without its CRC being checked. Any other file is read
+// into memory first, checking its CRC.
+func (zf *File) OpenReaderAt(name string) (io.ReaderAt, int64, error) {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return nil, 0, newZipError("OpenReaderAt", ErrFileNotFound)
+	}
+	fh := &zf.fileHeaders[i]
+	if fh.compressionMethod == COMPRESS_STORED && fh.flags&FLAG_ENCRYPTED == 0 {
+		// The data is read straight from the archive, so a size that doesn't match would
+		// read past the file into whatever follows it
+		if fh.compressedSize != fh.uncompressedSize {
+			return nil, 0, newZipErrorStr("OpenReaderAt", fmt.Sprintf("stored file %s has different compressed and uncompressed sizes", fh.fileName))
+		}
+		offset, err := zf.dataOffset(fh)
+		if err != nil {
+			return nil, 0, newZipError("OpenReaderAt", err)
+		}
+		return io.NewSectionReader(zf.r, offset, int64(fh.uncompressedSize)), int64(fh.uncompressedSize), nil
+	}
+	data, err := zf.readFileData(fh)
+	if err != nil {
+		return nil, 0, newZipError("OpenReaderAt", err)
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// OpenRaw returns a reader for the data of the file with the given name exactly as
+// it's stored in the archive (still compressed, and encrypted if the file is), along
+// with the file's metadata. The data isn't decompressed or checked against its CRC.
+func (zf *File) OpenRaw(name string) (io.Reader, Entry, error) {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return nil, Entry{}, newZipError("OpenRaw", ErrFileNotFound)
+	}
+	fh := &zf.fileHeaders[i]
+	fileData, err := zf.rawFileData(fh)
+	if err != nil {
+		return nil, Entry{}, newZipError("OpenRaw", err)
+	}
+	return fileData, fh.entry(zf.timeLocation()), nil
+}
+
+func (ef *entryFile) Stat() (fs.FileInfo, error) {
+	return entryInfo{fh: ef.fh, loc: ef.loc}, nil
+}
+
+func (ef *entryFile) Read(p []byte) (int, error) {
+	n, err := ef.r.Read(p)
+	ef.crc.Write(p[:n])
+	if err == io.EOF && !ef.fh.crcMatches(ef.crc.Sum32()) {
+		return n, newZipErrorStr("Read", "CRC mismatch in "+ef.fh.fileName)
+	}
+	return n, err
+}
+
+// Close releases the file's decompressor.
+func (ef *entryFile) Close() error {
+	return ef.r.Close()
+}
+
+func (ei entryInfo) Name() string {
+	return path.Base(ei.fh.fileName)
+}
+
+func (ei entryInfo) Size() int64 {
+	return int64(ei.fh.uncompressedSize)
+}
+
+func (ei entryInfo) Mode() fs.FileMode {
+	return ei.fh.fileMode()
+}
+
+func (ei entryInfo) ModTime() time.Time {
+	return ei.fh.getDateTime(ei.loc)
+}
+
+func (ei entryInfo) IsDir() bool {
+	return strings.HasSuffix(ei.fh.fileName, "/")
+}
+
+// Sys returns the file's Entry.
+func (ei entryInfo) Sys() any {
+	return ei.fh.entry(ei.loc)
+}
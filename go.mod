@@ -4,4 +4,8 @@ go 1.23.3
 
 require github.com/spf13/afero v1.11.0
 
-require golang.org/x/text v0.14.0 // indirect
+require golang.org/x/text v0.14.0
+
+require github.com/klauspost/compress v1.17.11
+
+require golang.org/x/crypto v0.16.0
@@ -0,0 +1,83 @@
+package zip
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// httpReaderAt is an io.ReaderAt that reads a remote file using HTTP range requests,
+// so that only the parts of the file that are actually read get downloaded.
+type httpReaderAt struct {
+	url    string       // URL of the remote file
+	client *http.Client // client used for every request
+	size   int64        // size of the remote file, from the HEAD request
+}
+
+// NewHTTPReaderAt returns an io.ReaderAt that reads the file at the given URL with
+// HTTP range requests, along with the size of the file. If client is nil,
+// http.DefaultClient is used. The server must report the file's size in response to
+// a HEAD request and must support range requests. Pass the results to NewReader to
+// read a remote archive without downloading the whole thing.
+func NewHTTPReaderAt(url string, client *http.Client) (io.ReaderAt, int64, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Head(url)
+	if err != nil {
+		return nil, 0, newZipError("HTTPReaderAt Head", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, newZipErrorStr("HTTPReaderAt Head", fmt.Sprintf("unexpected status %q", resp.Status))
+	}
+	if resp.ContentLength < 0 {
+		return nil, 0, newZipErrorStr("HTTPReaderAt Head", "server didn't report the file size")
+	}
+
+	return &httpReaderAt{url: url, client: client, size: resp.ContentLength}, resp.ContentLength, nil
+}
+
+// ReadAt reads len(p) bytes starting at offset off with a single range request.
+// Like any io.ReaderAt, it returns io.EOF if fewer bytes are available.
+func (r *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, newZipErrorStr("HTTPReaderAt ReadAt", "negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Don't ask for anything past the end of the file
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return 0, newZipError("HTTPReaderAt ReadAt", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end-1))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, newZipError("HTTPReaderAt ReadAt", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, newZipErrorStr("HTTPReaderAt ReadAt", fmt.Sprintf("server didn't honor range request (status %q)", resp.Status))
+	}
+
+	n, err := io.ReadFull(resp.Body, p[:end-off])
+	if err != nil {
+		return n, newZipError("HTTPReaderAt ReadAt", err)
+	}
+	if end-off < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
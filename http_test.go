@@ -0,0 +1,102 @@
+package zip
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPReaderAt(t *testing.T) {
+	// Build an archive in memory and serve it with range request support
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	writer, err := zipWriter.Create("file1.txt")
+	if err != nil {
+		t.Fatalf("zipWriter.Create returned error: %v", err)
+	}
+	_, err = writer.Write([]byte("Served over HTTP."))
+	if err != nil {
+		t.Fatalf("writer.Write returned error: %v", err)
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		t.Fatalf("zipWriter.Close returned error: %v", err)
+	}
+	data := buf.Bytes()
+
+	rangeRequests := 0
+	fullRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			rangeRequests++
+		} else if r.Method != http.MethodHead {
+			fullRequests++
+		}
+		http.ServeContent(w, r, "test.zip", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	r, size, err := NewHTTPReaderAt(server.URL, server.Client())
+	if err != nil {
+		t.Fatalf("NewHTTPReaderAt returned error: %v", err)
+	}
+	if size != int64(len(data)) {
+		t.Errorf("NewHTTPReaderAt returned size %d; Want: %d", size, len(data))
+	}
+
+	// A read in the middle of the file
+	p := make([]byte, 10)
+	n, err := r.ReadAt(p, 4)
+	if err != nil {
+		t.Errorf("ReadAt returned error: %v", err)
+	}
+	if !bytes.Equal(p[:n], data[4:14]) {
+		t.Errorf("ReadAt returned %x; Want: %x", p[:n], data[4:14])
+	}
+
+	// A read running past the end of the file
+	p = make([]byte, 10)
+	n, err = r.ReadAt(p, size-4)
+	if err != io.EOF {
+		t.Errorf("ReadAt past the end returned error %v; Want: %v", err, io.EOF)
+	}
+	if !bytes.Equal(p[:n], data[size-4:]) {
+		t.Errorf("ReadAt past the end returned %x; Want: %x", p[:n], data[size-4:])
+	}
+	if rangeRequests != 2 {
+		t.Errorf("server got %d range requests; Want: 2", rangeRequests)
+	}
+
+	// The reader is enough to parse the archive
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	if len(zipReader.File) != 1 || zipReader.File[0].Name != "file1.txt" {
+		t.Errorf("zip.NewReader found unexpected files: %v", zipReader.File)
+	}
+
+	// And to read the archive with this package, only with range requests
+	rangeRequests = 0
+	zf, err := NewReader(r, size)
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	fileData, err := zf.ReadFile("file1.txt")
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+	if string(fileData) != "Served over HTTP." {
+		t.Errorf("ReadFile returned %q; Want: %q", fileData, "Served over HTTP.")
+	}
+	if rangeRequests == 0 {
+		t.Error("server got no range requests from NewReader and ReadFile")
+	}
+	if fullRequests != 0 {
+		t.Errorf("server got %d requests for the whole file; Want: 0", fullRequests)
+	}
+}
@@ -0,0 +1,36 @@
+package zip
+
+import (
+	"archive/zip"
+	"io"
+)
+
+// AsStdReader returns an archive/zip Reader for the archive, for using the standard
+// library's zip package on it. It reads the archive as it is on disk, so it doesn't
+// see changes that haven't been saved, and it's only valid until the archive is
+// rewritten or closed.
+func (zf *File) AsStdReader() (*zip.Reader, error) {
+	r, err := zip.NewReader(io.NewSectionReader(zf.r, 0, zf.size), zf.size)
+	if err != nil {
+		return nil, newZipError("AsStdReader", err)
+	}
+	return r, nil
+}
+
+// FileHeader returns an archive/zip FileHeader with the entry's metadata. Passing it
+// to zip.Writer's CreateHeader and writing the file's contents (from ReadFile) copies
+// the file into an archive written by the standard library.
+func (e Entry) FileHeader() zip.FileHeader {
+	return zip.FileHeader{
+		Name:               e.Name,
+		Comment:            e.Comment,
+		CreatorVersion:     e.CreatorVersion,
+		Flags:              e.Flags,
+		Method:             uint16(e.Method),
+		Modified:           e.Modified,
+		CRC32:              e.CRC32,
+		CompressedSize64:   uint64(e.CompressedSize),
+		UncompressedSize64: uint64(e.UncompressedSize),
+		ExternalAttrs:      e.ExternalAttr,
+	}
+}
@@ -0,0 +1,94 @@
+package zip
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestAsStdReader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "First comment", []byte("This archive contains some text files.")},
+		{"dir/filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	r, err := zf.AsStdReader()
+	if err != nil {
+		t.Fatalf("AsStdReader returned error: %v", err)
+	}
+	if len(r.File) != len(files) {
+		t.Fatalf("Reader has %d files; Want: %d", len(r.File), len(files))
+	}
+	for i, f := range files {
+		if r.File[i].Name != f.name || r.File[i].Comment != f.comment {
+			t.Errorf("File %d is %s with comment %q; Want: %s with %q", i, r.File[i].Name, r.File[i].Comment, f.name, f.comment)
+		}
+	}
+}
+
+func TestEntryFileHeader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "First comment", []byte("This archive contains some text files.")},
+		{"dir/filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	// Copy every file into an archive written by archive/zip
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, e := range zf.List() {
+		header := e.FileHeader()
+		writer, err := zipWriter.CreateHeader(&header)
+		if err != nil {
+			t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+		}
+		data, err := zf.ReadFile(e.Name)
+		if err != nil {
+			t.Fatalf("ReadFile returned error: %v", err)
+		}
+		writer.Write(data)
+	}
+	zipWriter.Close()
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	entries := zf.List()
+	for i, f := range r.File {
+		e := entries[i]
+		if f.Name != e.Name || f.Comment != e.Comment || f.CRC32 != e.CRC32 || !f.Modified.Equal(e.Modified) {
+			t.Errorf("archive/zip read %v; Want it to match %v", f.FileHeader, e)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Open returned error: %v", err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Reading returned error: %v", err)
+		} else if !bytes.Equal(data, files[i].data) {
+			t.Errorf("%s has data %q; Want: %q", f.Name, data, files[i].data)
+		}
+	}
+}
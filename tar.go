@@ -0,0 +1,70 @@
+package zip
+
+import (
+	"archive/tar"
+	"hash/crc32"
+	"io"
+)
+
+// WriteTar writes every file in the archive to w as a tar stream, decompressing each
+// one and checking its CRC as it goes. Each tar header has the file's name,
+// permissions, modification time, size, and owner (if the archive has one).
+// Directories and symlinks become tar directories and symlinks. Nothing is written to
+// disk, and w doesn't need to seek.
+func (zf *File) WriteTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for i := range zf.fileHeaders {
+		err := zf.writeTarEntry(tw, &zf.fileHeaders[i])
+		if err != nil {
+			return newZipError("WriteTar", err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return newZipError("WriteTar", err)
+	}
+	return nil
+}
+
+// writeTarEntry writes the file with the given header to tw.
+func (zf *File) writeTarEntry(tw *tar.Writer, fh *fileHeader) error {
+	mode := fh.fileMode()
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     fh.fileName,
+		Mode:     int64(mode.Perm()),
+		ModTime:  fh.getDateTime(zf.timeLocation()),
+	}
+	uid, gid, ok := fh.owner()
+	if ok {
+		header.Uid = uid
+		header.Gid = gid
+	}
+
+	switch {
+	case mode.IsDir():
+		header.Typeflag = tar.TypeDir
+		return tw.WriteHeader(header)
+	case fh.isSymlink():
+		target, err := zf.readFileData(fh)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = string(target)
+		return tw.WriteHeader(header)
+	}
+
+	fileData, err := zf.openFileData(fh)
+	if err != nil {
+		return err
+	}
+	defer fileData.Close()
+	header.Size = int64(fh.uncompressedSize)
+	err = tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, &entryFile{fh: *fh, loc: zf.timeLocation(), r: fileData, crc: crc32.NewIEEE()})
+	return err
+}
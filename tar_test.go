@@ -0,0 +1,68 @@
+package zip
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestWriteTar(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"dir/", "", []byte{}},
+		{"dir/filebeta.txt", "", []byte("Second file in the archive.")},
+		{"empty.txt", "", []byte{}},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	var buf bytes.Buffer
+	err = zf.WriteTar(&buf)
+	if err != nil {
+		t.Fatalf("WriteTar returned error: %v", err)
+	}
+
+	tr := tar.NewReader(&buf)
+	entries := zf.List()
+	for i, f := range files {
+		header, err := tr.Next()
+		if err != nil {
+			t.Fatalf("tr.Next returned error: %v", err)
+		}
+		if header.Name != f.name {
+			t.Errorf("Tar entry %d is named %s; Want: %s", i, header.Name, f.name)
+		}
+		if !header.ModTime.Equal(entries[i].Modified) {
+			t.Errorf("%s has modification time %v; Want: %v", f.name, header.ModTime, entries[i].Modified)
+		}
+		if f.name == "dir/" {
+			if header.Typeflag != tar.TypeDir {
+				t.Errorf("%s has type %c; Want: %c", f.name, header.Typeflag, tar.TypeDir)
+			}
+			continue
+		}
+		if header.Typeflag != tar.TypeReg || header.Mode != DEFAULT_PERM {
+			t.Errorf("%s has type %c and mode %o; Want: %c and %o", f.name, header.Typeflag, header.Mode, tar.TypeReg, DEFAULT_PERM)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Reading %s returned error: %v", f.name, err)
+		}
+		if !bytes.Equal(data, f.data) {
+			t.Errorf("%s has data %q; Want: %q", f.name, data, f.data)
+		}
+	}
+	_, err = tr.Next()
+	if err != io.EOF {
+		t.Errorf("tr.Next returned %v after the last entry; Want: io.EOF", err)
+	}
+}
@@ -0,0 +1,153 @@
+package zip
+
+import (
+	"compress/flate"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// Writer writes a new zip archive to an io.Writer as a stream. Unlike File, it never
+// seeks or rewrites anything, so it works on pipes, sockets, and HTTP responses. Each
+// entry's CRC and sizes follow its data in a data descriptor.
+type Writer struct {
+	w       *countingWriter
+	headers []fileHeader // file headers for the entries written so far
+	entry   *entryWriter // the entry being written, if any
+	closed  bool
+}
+
+// entryWriter is the io.Writer for an entry's data. It keeps track of the CRC and
+// size of the data written, and where the data started in the archive.
+type entryWriter struct {
+	zw    *Writer
+	w     io.Writer     // where the data goes: zw.w, or fw for deflated entries
+	fw    *flate.Writer // the deflate compressor, if the entry is deflated
+	crc   hash.Hash32
+	text  textDetector
+	size  int64
+	start int64
+}
+
+// NewWriter returns a Writer that writes a new zip archive to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: &countingWriter{w: w}}
+}
+
+// CreateEntry starts a new entry in the archive with the given name, and returns an
+// io.Writer for its data. The io.Writer is only valid until the next call to
+// CreateEntry or Close.
+func (zw *Writer) CreateEntry(name string, method CompressionMethod) (io.Writer, error) {
+	err := checkWriteMethod("CreateEntry", method)
+	if err != nil {
+		return nil, err
+	}
+	if zw.closed {
+		return nil, newZipErrorStr("CreateEntry", "writer is closed")
+	}
+	name, err = entryName(name)
+	if err != nil {
+		return nil, newZipError("CreateEntry", err)
+	}
+	if len(zw.headers) >= math.MaxUint16 {
+		return nil, newZipErrorStr("CreateEntry", "too many entries")
+	}
+	err = zw.finishEntry()
+	if err != nil {
+		return nil, err
+	}
+
+	if zw.w.n > math.MaxUint32 {
+		return nil, newZipErrorStr("CreateEntry", "archive is too large")
+	}
+	fh := newHeader(name, method, time.Now(), 0, 0)
+	fh.flags |= FLAG_DATA_DESCRIPTOR
+	fh.offsetLocalHeader = uint32(zw.w.n)
+	err = writeLocalHeader(zw.w, &fh)
+	if err != nil {
+		return nil, newZipError("CreateEntry", err)
+	}
+	zw.headers = append(zw.headers, fh)
+	zw.entry = &entryWriter{zw: zw, w: zw.w, crc: crc32.NewIEEE(), start: zw.w.n}
+	if method == COMPRESS_DEFLATED {
+		zw.entry.fw, err = flate.NewWriter(zw.w, fh.level)
+		if err != nil {
+			return nil, newZipError("CreateEntry", err)
+		}
+		zw.entry.w = zw.entry.fw
+	}
+	return zw.entry, nil
+}
+
+func (ew *entryWriter) Write(p []byte) (int, error) {
+	if ew.zw.entry != ew {
+		return 0, newZipErrorStr("Write", "entry is finished")
+	}
+	n, err := ew.w.Write(p)
+	ew.crc.Write(p[:n])
+	ew.text.Write(p[:n])
+	ew.size += int64(n)
+	return n, err
+}
+
+// finishEntry writes the data descriptor for the entry being written, if any.
+func (zw *Writer) finishEntry() error {
+	if zw.entry == nil {
+		return nil
+	}
+	ew := zw.entry
+	zw.entry = nil
+	if ew.fw != nil {
+		err := ew.fw.Close()
+		if err != nil {
+			return newZipError("CreateEntry", err)
+		}
+	}
+	compressedSize := zw.w.n - ew.start
+	if ew.size > math.MaxUint32 || compressedSize > math.MaxUint32 {
+		return newZipErrorStr("CreateEntry", "entry is too large")
+	}
+	fh := &zw.headers[len(zw.headers)-1]
+	fh.crc = ew.crc.Sum32()
+	fh.internalAttr = textAttr(ew.text.isText()) // only in the central directory, so it can wait
+	fh.compressedSize = uint32(compressedSize)
+	fh.uncompressedSize = uint32(ew.size)
+	err := writeDataDescriptor(zw.w, fh)
+	if err != nil {
+		return newZipError("CreateEntry", err)
+	}
+	return nil
+}
+
+// Close finishes the archive by writing the central directory and the
+// end-of-central-directory record. It doesn't close the underlying io.Writer.
+func (zw *Writer) Close() error {
+	if zw.closed {
+		return newZipErrorStr("Close", "writer is closed")
+	}
+	zw.closed = true
+	err := zw.finishEntry()
+	if err != nil {
+		return err
+	}
+
+	centralDirOffset := zw.w.n
+	for i := range zw.headers {
+		err = writeCentralDirHeader(zw.w, &zw.headers[i])
+		if err != nil {
+			return newZipError("Close", err)
+		}
+	}
+	centralDirSize := zw.w.n - centralDirOffset
+	if centralDirOffset > math.MaxUint32 || centralDirSize > math.MaxUint32 {
+		return newZipErrorStr("Close", "archive is too large")
+	}
+
+	err = writeEndOfCentralDir(zw.w, uint16(len(zw.headers)), uint32(centralDirSize), uint32(centralDirOffset), nil)
+	if err != nil {
+		return newZipError("Close", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package zip
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"dir/filebeta.txt", "", []byte("Second file in the archive.")},
+		{"empty.txt", "", []byte{}},
+	}
+
+	// bytes.Buffer can't seek, so everything has to be streamed
+	var buf bytes.Buffer
+	zw := NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.CreateEntry(f.name, COMPRESS_STORED)
+		if err != nil {
+			t.Fatalf("CreateEntry returned error: %v", err)
+		}
+		// Write in two pieces to make sure the CRC and size add up
+		half := len(f.data) / 2
+		w.Write(f.data[:half])
+		w.Write(f.data[half:])
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	_, err = zw.CreateEntry("late.txt", COMPRESS_STORED)
+	if err == nil {
+		t.Error("CreateEntry should return an error after Close")
+	}
+
+	// Check the archive with a different zip reader...
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	if len(zipReader.File) != len(files) {
+		t.Fatalf("Archive has %d files; Want: %d", len(zipReader.File), len(files))
+	}
+	for i, f := range files {
+		if zipReader.File[i].Name != f.name {
+			t.Errorf("File %d is named %s; Want: %s", i, zipReader.File[i].Name, f.name)
+		}
+		rc, err := zipReader.File[i].Open()
+		if err != nil {
+			t.Fatalf("Open returned error: %v", err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("io.ReadAll(%s) returned error: %v", f.name, err)
+		} else if !bytes.Equal(data, f.data) {
+			t.Errorf("%s has data %q; Want: %q", f.name, data, f.data)
+		}
+	}
+
+	// ...and with ours
+	zf, err := OpenBytes(buf.Bytes())
+	if err != nil {
+		t.Fatalf("OpenBytes returned error: %v", err)
+	}
+	err = zf.VerifyAll()
+	if err != nil {
+		t.Errorf("VerifyAll returned error: %v", err)
+	}
+}
+
+func TestWriterDeflated(t *testing.T) {
+	data := bytes.Repeat([]byte("This file is deflated as it's streamed. "), 100)
+	var buf bytes.Buffer
+	zw := NewWriter(&buf)
+	w, err := zw.CreateEntry("file1.txt", COMPRESS_DEFLATED)
+	if err != nil {
+		t.Fatalf("CreateEntry returned error: %v", err)
+	}
+	w.Write(data)
+	err = zw.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	f := zipReader.File[0]
+	if f.Method != zip.Deflate || f.CompressedSize64 >= f.UncompressedSize64 {
+		t.Errorf("File has method %d and compressed size %d; Want: deflated and smaller than %d", f.Method, f.CompressedSize64, f.UncompressedSize64)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatalf("Open returned error: %v", err)
+	}
+	read, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("Reading returned error: %v", err)
+	} else if !bytes.Equal(read, data) {
+		t.Errorf("File has data %q; Want: %q", read, data)
+	}
+}
+
+func TestWriterUnsupportedMethod(t *testing.T) {
+	zw := NewWriter(io.Discard)
+	_, err := zw.CreateEntry("file1.txt", COMPRESS_BZIP2)
+	if err == nil {
+		t.Error("CreateEntry should return an error for an unsupported compression method")
+	}
+}
@@ -1,30 +1,64 @@
 package zip
 
 import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/fs"
 	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/afero"
 )
 
-// File represents a zip file. It contains fields for I/O (fs, name, file),
+// File represents a zip file. It contains fields for I/O (fs, name, file, r, size),
 // fields corresponding to the end-of-central-directory record (numEntries,
-// centralDirSize, centralDirOffset, commentLength, comment), and a slice
-// of file headers from the central directory (fileHeaders).
+// centralDirSize, centralDirOffset, commentLength, comment), a slice of file
+// headers from the central directory (fileHeaders), and the lengths of anything
+// before the zip data (prefixLength, stubLength). It also holds options
+// that change how the archive is read (preferLastDuplicate, lazy, location,
+// restoreOwner, password) and the options for AddFileDefault (defaults).
+//
+// Methods that only read the archive (like List, ReadFile, OpenEntry, VerifyAll, and
+// the Extract methods) are safe to call from several goroutines at once. Methods that
+// change the archive (like AddFile, RemoveFile, SetFileComment, and Save) aren't safe
+// to call at the same time as any other method.
 type File struct {
 	fs               afero.Fs     // Use afero for the sake of testing
 	Name             string       // zip file name
-	file             afero.File   // file handle for the archive
+	file             afero.File   // file handle for the archive, if it's on fs
+	r                io.ReaderAt  // reader for the archive's contents
+	size             int64        // size of the archive in bytes
 	numEntries       uint16       // number of entries in the central directory
 	centralDirSize   uint32       // size of the central directory
 	centralDirOffset uint32       // offset of the central directory, relative to the start of the file
 	commentLength    uint16       // length of the zip file comment
 	comment          []byte       // zip file comment
 	fileHeaders      []fileHeader // file headers from the central directory
+	prefixLength     int64        // length of any data that the archive's offsets don't count
+	stubLength       int64        // length of the data before the first local header, like a self-extracting stub
+
+	preferLastDuplicate bool           // whether the last of several files with the same name wins
+	lazy                bool           // whether local headers are only read when they're needed
+	location            *time.Location // time zone of DOS times, or nil for time.Local
+	restoreOwner        bool           // whether extracting sets the owner from the Unix extra field
+	password            string         // password for WinZip AES files, or "" for none
+	defaults            AddOptions     // how AddFileDefault stores files, from CreateArchive
 }
 
 // FileHeader represents a file header from the zip file's central directory. Each field
@@ -47,7 +81,71 @@ type fileHeader struct {
 	externalAttr       uint32
 	offsetLocalHeader  uint32
 	fileName           string
+	extra              []byte // the extra field from the central file header
 	comment            string
+	localOwner         []byte // the UID and GID from the local header's old Unix extra field
+
+	// source opens the data for a file that hasn't been written to the archive yet.
+	// It's nil for files whose data is already in the archive. raw is whether source
+	// returns the data as it's stored (already compressed), like a file copied from
+	// another archive. Otherwise, if the file is deflated, level is the compression
+	// level to deflate it with.
+	source func() (io.ReadCloser, error)
+	raw    bool
+	level  int
+}
+
+// Entry describes a file in the archive. It's a copy of the file's metadata from
+// the central directory, so changing it doesn't change the archive.
+type Entry struct {
+	Name             string            // file name
+	Comment          string            // file comment
+	Method           CompressionMethod // compression method
+	Flags            uint16            // general purpose flags
+	CRC32            uint32            // CRC-32 of the uncompressed data
+	CompressedSize   uint32            // size of the file's data in the archive
+	UncompressedSize uint32            // size of the file once it's extracted
+	Modified         time.Time         // modification time
+	CreatorVersion   uint16            // "version made by", whose upper byte is the host system
+	ExternalAttr     uint32            // external file attributes
+	Mode             fs.FileMode       // file mode, from ExternalAttr
+	UID              int               // owner's user ID from the Unix extra field, or -1
+	GID              int               // owner's group ID from the Unix extra field, or -1
+}
+
+// ModifiedISO returns the entry's modification time as an ISO 8601 (RFC 3339)
+// string, which includes the time zone offset.
+func (e Entry) ModifiedISO() string {
+	return e.Modified.Format(time.RFC3339)
+}
+
+// IsEncrypted returns whether the entry's data is encrypted.
+func (e Entry) IsEncrypted() bool {
+	return e.Flags&FLAG_ENCRYPTED != 0
+}
+
+func (fh *fileHeader) entry(loc *time.Location) Entry {
+	e := Entry{
+		Name:             fh.fileName,
+		Comment:          fh.comment,
+		Method:           CompressionMethod(fh.compressionMethod),
+		Flags:            fh.flags,
+		CRC32:            fh.crc,
+		CompressedSize:   fh.compressedSize,
+		UncompressedSize: fh.uncompressedSize,
+		Modified:         fh.getDateTime(loc),
+		CreatorVersion:   fh.versionMadeBy,
+		ExternalAttr:     fh.externalAttr,
+		Mode:             fh.fileMode(),
+		UID:              -1,
+		GID:              -1,
+	}
+	uid, gid, ok := fh.owner()
+	if ok {
+		e.UID = uid
+		e.GID = gid
+	}
+	return e
 }
 
 func Create(archiveName string, fileName string, method CompressionMethod) (*File, error) {
@@ -71,6 +169,59 @@ func CreateWithFs(fs afero.Fs, archiveName string, fileName string, method Compr
 	return &zf, err
 }
 
+// CreateEmpty creates a new zip file with the given name that has no files in it, and
+// returns a zip.File for adding files to it.
+func CreateEmpty(archiveName string) (*File, error) {
+	return CreateEmptyWithFs(afero.NewOsFs(), archiveName)
+}
+
+// CreateEmptyWithFs is like CreateEmpty, but it uses the given afero.Fs instead of the
+// default os file system.
+func CreateEmptyWithFs(fs afero.Fs, archiveName string) (*File, error) {
+	zf := File{
+		Name:             archiveName,
+		fs:               fs,
+		centralDirSize:   CENTRAL_DIR_MIN_SIZE,
+		centralDirOffset: 0,
+	}
+	err := zf.rewriteArchive(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &zf, nil
+}
+
+// CreateArchive creates a new zip file with the given name on fs that has no files in
+// it, and returns a zip.File for adding files to it. opts gives the archive's comment,
+// and the compression method and level for files added with AddFileDefault.
+func CreateArchive(fs afero.Fs, name string, opts CreateOptions) (*File, error) {
+	err := checkWriteMethod("CreateArchive", opts.Method)
+	if err != nil {
+		return nil, err
+	}
+	err = checkLevel("CreateArchive", opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Comment) > math.MaxUint16 {
+		return nil, newZipErrorStr("CreateArchive", "comment is longer than 65535 bytes")
+	}
+	zf := File{
+		Name:             name,
+		fs:               fs,
+		centralDirSize:   CENTRAL_DIR_MIN_SIZE,
+		centralDirOffset: 0,
+		commentLength:    uint16(len(opts.Comment)),
+		comment:          []byte(opts.Comment),
+		defaults:         AddOptions{Method: opts.Method, Level: opts.Level},
+	}
+	err = zf.rewriteArchive(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &zf, nil
+}
+
 // Open opens an existing zip file with the given name and returns a zip.File
 // that can be used to interact with the zip file.
 func Open(name string) (*File, error) {
@@ -82,329 +233,589 @@ func Open(name string) (*File, error) {
 // of the default os file system.
 func OpenWithFs(name string, fs afero.Fs) (*File, error) {
 	zf := File{Name: name, fs: fs}
-	file, err := zf.fs.Open(name)
+	err := zf.openArchiveFile()
+	if err != nil {
+		return nil, err
+	}
+
+	err = zf.readDirectory()
+	if err != nil {
+		zf.file.Close()
+		return nil, err
+	}
+	return &zf, nil
+}
+
+// OpenLazy opens an existing zip file like Open, but only reads the central directory.
+// Each file's local header is read when its data is needed, instead of all of them
+// being checked up front, so huge archives open quickly.
+func OpenLazy(name string) (*File, error) {
+	return OpenLazyWithFs(name, afero.NewOsFs())
+}
+
+// OpenLazyWithFs is like OpenLazy, but uses the given afero.Fs instead of the default
+// os file system.
+func OpenLazyWithFs(name string, fs afero.Fs) (*File, error) {
+	zf := File{Name: name, fs: fs, lazy: true}
+	err := zf.openArchiveFile()
 	if err != nil {
 		return nil, err
 	}
-	zf.file = file
 
 	err = zf.readDirectory()
+	if err != nil {
+		zf.file.Close()
+		return nil, err
+	}
+	return &zf, nil
+}
+
+// NewReader returns a zip.File that reads the archive from r, which has the given
+// size in bytes. The zip.File is read-only: it has no file system, so methods that
+// change the archive (like AddFile, RemoveFile, SetFileComment, Save, and Batch's
+// Commit) and the Extract methods that write to the archive's file system (like
+// ExtractFile and ExtractAllTo) return ErrReadOnly. ExtractFileToFs and
+// ExtractAllToFs work, since they're given a file system to write to, as do WriteTo
+// and WriteStream.
+func NewReader(r io.ReaderAt, size int64) (*File, error) {
+	zf := File{r: r, size: size}
+	err := zf.readDirectory()
 	if err != nil {
 		return nil, err
 	}
 	return &zf, nil
 }
 
+// OpenBytes returns a read-only zip.File for the archive in data, like NewReader.
+func OpenBytes(data []byte) (*File, error) {
+	return NewReader(bytes.NewReader(data), int64(len(data)))
+}
+
+// openArchiveFile opens the archive named zf.Name on zf.fs for reading.
+func (zf *File) openArchiveFile() error {
+	file, err := zf.fs.Open(zf.Name)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	zf.file = file
+	zf.r = &lockedReaderAt{r: file}
+	zf.size = info.Size()
+	return nil
+}
+
+// checkWritable returns ErrReadOnly if the archive has no file system to write to.
+func (zf *File) checkWritable(operation string) error {
+	if zf.fs == nil {
+		return newZipError(operation, ErrReadOnly)
+	}
+	return nil
+}
+
+// readAt reads len(p) bytes of the archive starting at offset off.
+func (zf *File) readAt(p []byte, off int64) error {
+	_, err := io.ReadFull(io.NewSectionReader(zf.r, off, int64(len(p))), p)
+	return err
+}
+
 // Close closes the underlying file associated with the zip.File.
 // It returns an error if the file cannot be closed.
 func (zf *File) Close() error {
+	if zf.file == nil {
+		return nil // Nothing to close for an archive from NewReader
+	}
 	return zf.file.Close()
 }
 
+// FS returns the file system that the archive lives on.
+func (zf *File) FS() afero.Fs {
+	return zf.fs
+}
+
+// checkEndOfCentralDir checks that record, an end of central directory record found at
+// offset eocdPos, is consistent with the rest of the archive: the central directory must
+// come before the record, and it must start with a central directory file header. It
+// returns ErrZip64 if any of the record's fields are all ones, meaning that the real
+// value is in a Zip64 record, and ErrMultiDisk if the archive is split across disks.
+func (zf *File) checkEndOfCentralDir(record []byte, eocdPos int64) error {
+	disk := binary.LittleEndian.Uint16(record[4:6])
+	centralDirDisk := binary.LittleEndian.Uint16(record[6:8])
+	diskEntries := binary.LittleEndian.Uint16(record[8:10])
+	numEntries := binary.LittleEndian.Uint16(record[10:12])
+	centralDirSize := binary.LittleEndian.Uint32(record[12:16])
+	centralDirOffset := binary.LittleEndian.Uint32(record[16:20])
+	if numEntries == math.MaxUint16 || centralDirSize == math.MaxUint32 || centralDirOffset == math.MaxUint32 {
+		return newZipError("ReadDir", ErrZip64)
+	}
+	if disk != 0 || centralDirDisk != 0 || diskEntries != numEntries {
+		return newZipError("ReadDir", ErrMultiDisk)
+	}
+
+	// The central directory comes before the end of central directory record. Check that
+	// before allocating space for it, since its size comes straight from the file.
+	if int64(centralDirOffset)+int64(centralDirSize) > eocdPos {
+		return newZipErrorStr("ReadDir", "central directory is malformed (extends past end of central directory record)")
+	}
+	if numEntries == 0 {
+		return nil
+	}
+	if int64(centralDirSize) < 46*int64(numEntries) {
+		return newZipErrorStr("ReadDir", "central directory is malformed (too small for its entries)")
+	}
+
+	// The central directory ends where the record starts, even if there's something
+	// before the zip data
+	signature := make([]byte, 4)
+	err := zf.readAt(signature, eocdPos-int64(centralDirSize))
+	if err != nil {
+		return newZipError("ReadDir Read Central Directory", err)
+	}
+	if !bytes.Equal(signature, []byte("\x50\x4b\x01\x02")) {
+		return newZipErrorStr("ReadDir", "couldn't find central directory file header signature")
+	}
+	return nil
+}
+
 // readDirectory reads the central directory of a zip file to populate the
-// File struct with metadata about the archive's contents. It seeks from the
+// File struct with metadata about the archive's contents. It reads from the
 // end of the file to locate the end-of-central-directory signature, reads
 // the central directory records, and extracts file headers into a slice.
 // It also handles reading the archive's comment if present. Errors are
 // returned if the directory signature cannot be found or if the directory
 // structure is malformed.
 func (zf *File) readDirectory() error {
-	// Start at the end of the file and look for the end of central directory signature
-	// End of central directory is record is 22 bytes plus the zip file comment.
-	// Start at EOF-22 and go backwards, looking for the end of central directory signature.
+	// End of central directory is record is 22 bytes plus the zip file comment, which is
+	// at most 65535 bytes. Read that much from the end of the file (or the whole file if
+	// it's smaller) and go backwards from EOF-22, looking for the end of central directory
+	// signature.
+	size := zf.size
+	if size < CENTRAL_DIR_MIN_SIZE {
+		return newZipErrorStr("ReadDir", "not a zip file (too small)")
+	}
+	tail := make([]byte, min(size, EOCD_MAX_SEARCH))
+	err := zf.readAt(tail, size-int64(len(tail)))
+	if err != nil {
+		return newZipError("ReadDir Read", err)
+	}
+	// The signature could just be bytes inside the comment or inside a file's data. The
+	// real record points to a central directory, so check for that. The real record's
+	// comment also runs exactly to the end of the file, unless something (like a
+	// signature block) was appended after the archive, so look for a record like that
+	// first, and then for one that's followed by extra bytes.
 	found := false
-	buffer := make([]byte, 22)
-	offset := int64(-22) // offset is measured from the end of the stream
-	for ; !found; offset-- {
-		pos, err := zf.file.Seek(offset, io.SeekEnd)
-		if err != nil || pos < 0 {
-			return newZipErrorStr("ReadDir Seek", "couldn't find end of directory signature")
-		}
-		err = binary.Read(zf.file, binary.LittleEndian, &buffer)
-		if err != nil {
-			return newZipError("ReadDir Read", err)
+	var firstErr error
+	eocdStart := 0
+	for _, exact := range []bool{true, false} {
+		for eocdStart = len(tail) - CENTRAL_DIR_MIN_SIZE; eocdStart >= 0; eocdStart-- {
+			if tail[eocdStart] != 0x50 || tail[eocdStart+1] != 0x4b || tail[eocdStart+2] != 0x05 || tail[eocdStart+3] != 0x06 {
+				continue
+			}
+			commentLength := binary.LittleEndian.Uint16(tail[eocdStart+20 : eocdStart+22])
+			recordEnd := eocdStart + CENTRAL_DIR_MIN_SIZE + int(commentLength)
+			if recordEnd > len(tail) || (exact && recordEnd != len(tail)) || (!exact && recordEnd == len(tail)) {
+				continue
+			}
+			err = zf.checkEndOfCentralDir(tail[eocdStart:], size-int64(len(tail))+int64(eocdStart))
+			if err == nil {
+				found = true
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
-		if buffer[0] == 0x50 && buffer[1] == 0x4b && buffer[2] == 0x05 && buffer[3] == 0x06 {
-			found = true
+		if found {
 			break
 		}
 	}
+	if !found && firstErr != nil {
+		return firstErr
+	}
 	if !found {
 		return newZipErrorStr("ReadDir Find", "couldn't find end of central directory signature")
 	}
 
-	// buffer contains 22 bytes of the end of central directory record, starting from signature.
-	// Now read the rest of the end of central directory record.
-	// Ignore anything involving a directory spanning multiple disks...
+	// buffer contains 22 bytes of the end of central directory record, starting from
+	// signature, followed by the zip file comment (and maybe bytes after the archive).
+	// checkEndOfCentralDir has already refused archives that span multiple disks, so the
+	// disk fields can be skipped.
+	buffer := tail[eocdStart:]
 	zf.numEntries = binary.LittleEndian.Uint16(buffer[10:12])
 	zf.centralDirSize = binary.LittleEndian.Uint32(buffer[12:16])
 	zf.centralDirOffset = binary.LittleEndian.Uint32(buffer[16:20])
 	zf.commentLength = binary.LittleEndian.Uint16(buffer[20:22])
 	if zf.commentLength > 0 {
-		zf.comment = make([]byte, zf.commentLength)
-		err := binary.Read(zf.file, binary.LittleEndian, &zf.comment)
-		if err != nil {
-			return newZipError("ReadDir Read Comment", err)
-		}
+		zf.comment = bytes.Clone(buffer[CENTRAL_DIR_MIN_SIZE : CENTRAL_DIR_MIN_SIZE+int(zf.commentLength)])
 	}
+	eocdPos := size - int64(len(tail)) + int64(eocdStart)
 
-	// Read the central directory
-	buffer = make([]byte, zf.centralDirSize)
-	_, err := zf.file.Seek(int64(zf.centralDirOffset), 0)
-	if err != nil {
-		return newZipError("ReadDir Seek Central Directory", err)
-	}
-	err = binary.Read(zf.file, binary.LittleEndian, &buffer)
-	if err != nil {
-		return newZipError("ReadDir Read Central Directory", err)
+	// The central directory should end right where the end of central directory record
+	// starts. If there's a gap, the zip data has something before it (like the stub of a
+	// self-extracting archive), and the offsets in the archive are relative to the start
+	// of the zip data rather than the start of the file. Make them all relative to the
+	// start of the file.
+	zf.prefixLength = eocdPos - int64(zf.centralDirSize) - int64(zf.centralDirOffset)
+	if int64(zf.centralDirOffset)+zf.prefixLength > math.MaxUint32 {
+		return newZipErrorStr("ReadDir", "archive is too large")
 	}
-	// buffer now contains the central directory. Read it into zf.fileHeaders
-	i := 0
+	zf.centralDirOffset += uint32(zf.prefixLength)
+
+	// Read the central directory one header at a time, so that only one header is in
+	// memory at once, however many entries there are
+	r := bufio.NewReader(io.NewSectionReader(zf.r, int64(zf.centralDirOffset), int64(zf.centralDirSize)))
+	buffer = make([]byte, 46)
 	for entry := 0; entry < int(zf.numEntries); entry++ {
-		if len(buffer) < i+46 {
+		_, err = io.ReadFull(r, buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			return newZipErrorStr("ReadDir", "central directory is malformed (<46 bytes)")
 		}
-		if buffer[i] != 0x50 || buffer[i+1] != 0x4b || buffer[i+2] != 0x01 || buffer[i+3] != 0x02 {
+		if err != nil {
+			return newZipError("ReadDir Read Central Directory", err)
+		}
+		if buffer[0] != 0x50 || buffer[1] != 0x4b || buffer[2] != 0x01 || buffer[3] != 0x02 {
 			return newZipErrorStr("ReadDir", "couldn't find central directory file header signature")
 		}
 		fh := fileHeader{}
-		fh.versionMadeBy = binary.LittleEndian.Uint16(buffer[i+4 : i+6])
-		fh.versionNeeded = binary.LittleEndian.Uint16(buffer[i+6 : i+8])
-		fh.flags = binary.LittleEndian.Uint16(buffer[i+8 : i+10])
-		fh.compressionMethod = binary.LittleEndian.Uint16(buffer[i+10 : i+12])
-		fh.dosTime = binary.LittleEndian.Uint16(buffer[i+12 : i+14])
-		fh.dosDate = binary.LittleEndian.Uint16(buffer[i+14 : i+16])
-		fh.crc = binary.LittleEndian.Uint32(buffer[i+16 : i+20])
-		fh.compressedSize = binary.LittleEndian.Uint32(buffer[i+20 : i+24])
-		fh.uncompressedSize = binary.LittleEndian.Uint32(buffer[i+24 : i+28])
-		fh.nameLength = binary.LittleEndian.Uint16(buffer[i+28 : i+30])
-		fh.extraLengthCentral = binary.LittleEndian.Uint16(buffer[i+30 : i+32])
-		fh.commentLength = binary.LittleEndian.Uint16(buffer[i+32 : i+34])
-		// don't bother with disk # start
-		fh.internalAttr = binary.LittleEndian.Uint16(buffer[i+36 : i+38])
-		fh.externalAttr = binary.LittleEndian.Uint32(buffer[i+38 : i+42])
-		fh.offsetLocalHeader = binary.LittleEndian.Uint32(buffer[i+42 : i+46])
-		if len(buffer) < i+46+int(fh.nameLength)+int(fh.extraLengthCentral)+int(fh.commentLength) {
+		fh.versionMadeBy = binary.LittleEndian.Uint16(buffer[4:6])
+		fh.versionNeeded = binary.LittleEndian.Uint16(buffer[6:8])
+		fh.flags = binary.LittleEndian.Uint16(buffer[8:10])
+		fh.compressionMethod = binary.LittleEndian.Uint16(buffer[10:12])
+		fh.dosTime = binary.LittleEndian.Uint16(buffer[12:14])
+		fh.dosDate = binary.LittleEndian.Uint16(buffer[14:16])
+		fh.crc = binary.LittleEndian.Uint32(buffer[16:20])
+		fh.compressedSize = binary.LittleEndian.Uint32(buffer[20:24])
+		fh.uncompressedSize = binary.LittleEndian.Uint32(buffer[24:28])
+		fh.nameLength = binary.LittleEndian.Uint16(buffer[28:30])
+		fh.extraLengthCentral = binary.LittleEndian.Uint16(buffer[30:32])
+		fh.commentLength = binary.LittleEndian.Uint16(buffer[32:34])
+		diskStart := binary.LittleEndian.Uint16(buffer[34:36])
+		fh.internalAttr = binary.LittleEndian.Uint16(buffer[36:38])
+		fh.externalAttr = binary.LittleEndian.Uint32(buffer[38:42])
+		fh.offsetLocalHeader = binary.LittleEndian.Uint32(buffer[42:46])
+
+		// The name, extra field, and comment follow the fixed-size part of the header
+		nameEnd := int(fh.nameLength)
+		extraEnd := nameEnd + int(fh.extraLengthCentral)
+		commentEnd := extraEnd + int(fh.commentLength)
+		variable := make([]byte, commentEnd)
+		_, err = io.ReadFull(r, variable)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			return newZipErrorStr("ReadDir", "central directory is malformed (not enough data)")
 		}
-		fh.fileName = string(buffer[i+46 : i+46+int(fh.nameLength)])
-		// This is where the extra field goes, but we're not bothering to keep it
+		if err != nil {
+			return newZipError("ReadDir Read Central Directory", err)
+		}
+		// Some old Windows tools use backslashes as the separator. The name is stored as it
+		// is until the archive is rewritten.
+		fh.fileName = strings.ReplaceAll(decodeText(variable[:nameEnd], fh.flags), "\\", "/")
+		if fh.extraLengthCentral > 0 {
+			fh.extra = variable[nameEnd:extraEnd]
+		}
 		if fh.commentLength > 0 {
-			fh.comment = string(buffer[i+46+int(fh.nameLength)+int(fh.extraLengthCentral) : i+46+int(fh.nameLength)+int(fh.extraLengthCentral)+int(fh.commentLength)])
+			fh.comment = decodeText(variable[extraEnd:commentEnd], fh.flags)
+		}
+		// All ones means that the real value is in the Zip64 extra field
+		if fh.compressedSize == math.MaxUint32 || fh.uncompressedSize == math.MaxUint32 || fh.offsetLocalHeader == math.MaxUint32 {
+			_, ok := extraField(fh.extra, EXTRA_ZIP64)
+			if ok {
+				return newZipError("ReadDir", fmt.Errorf("%w (entry %q)", ErrZip64, fh.fileName))
+			}
+		}
+		if diskStart != 0 {
+			return newZipError("ReadDir", fmt.Errorf("%w (entry %q is on another disk)", ErrMultiDisk, fh.fileName))
+		}
+		if int64(fh.offsetLocalHeader)+zf.prefixLength > math.MaxUint32 {
+			return newZipErrorStr("ReadDir", "central directory is malformed (local header offset is too large)")
 		}
+		fh.offsetLocalHeader += uint32(zf.prefixLength)
 		zf.fileHeaders = append(zf.fileHeaders, fh)
-		i += 46 + int(fh.nameLength) + int(fh.extraLengthCentral) + int(fh.commentLength)
+	}
+
+	// Anything before the first local header (or the central directory, if there are no
+	// files) is a stub to keep when the archive is rewritten. Its offsets might count
+	// the stub (like "zip -A" makes them) or not, so prefixLength alone doesn't find it.
+	zf.stubLength = int64(zf.centralDirOffset)
+	for _, fh := range zf.fileHeaders {
+		zf.stubLength = min(zf.stubLength, int64(fh.offsetLocalHeader))
 	}
 
 	// Check the local file headers. Local headers are sometimes different from the central
 	// ones (a bizarre feature of the zip format). So don't do error checking on most things.
+	// In particular, the CRC and sizes are zero in the local header when the file has a
+	// data descriptor.
 	// BUT we do need to keep track of the extra field length here (which may not be the same
 	// as the extra field length in the central directory); that's important for seeking.
-	for i, fh := range zf.fileHeaders {
-		_, err := zf.file.Seek(int64(fh.offsetLocalHeader), io.SeekStart)
-		if err != nil {
-			return newZipError("ReadDir Seek Local File Header", err)
-		}
-		buffer := make([]byte, 30)
-		err = binary.Read(zf.file, binary.LittleEndian, &buffer)
+	// A lazy archive skips this, and reads each local header when the file's data is needed.
+	if zf.lazy {
+		return nil
+	}
+	for i := range zf.fileHeaders {
+		extraLength, err := zf.readLocalHeader(&zf.fileHeaders[i])
 		if err != nil {
-			return newZipError("ReadDir Read Local File Header", err)
-		}
-		if buffer[0] != 0x50 || buffer[1] != 0x4b || buffer[2] != 0x03 || buffer[3] != 0x04 {
-			return newZipErrorStr("ReadDir", "couldn't find local file header signature")
+			return err
 		}
-		if fh.nameLength != binary.LittleEndian.Uint16(buffer[26:28]) {
-			return newZipErrorStr("ReadDir", "local file header doesn't match central directory (filename length)")
+		zf.fileHeaders[i].extraLengthLocal = extraLength
+
+		// The old Unix field only has the owner in the local header. The central header
+		// has the field too (with just the times), so only look when it's there.
+		_, ok := extraField(zf.fileHeaders[i].extra, EXTRA_UNIX_OLD)
+		if ok && extraLength > 0 {
+			zf.fileHeaders[i].localOwner, err = zf.readLocalOwner(&zf.fileHeaders[i], extraLength)
+			if err != nil {
+				return err
+			}
 		}
-		zf.fileHeaders[i].extraLengthLocal = binary.LittleEndian.Uint16(buffer[28:30])
 	}
 
 	return nil
 }
 
+// readLocalHeader checks the local file header for fh and returns the length of its
+// extra field.
+func (zf *File) readLocalHeader(fh *fileHeader) (uint16, error) {
+	buffer := make([]byte, 30)
+	err := zf.readAt(buffer, int64(fh.offsetLocalHeader))
+	if err != nil {
+		return 0, newZipError("ReadDir Read Local File Header", err)
+	}
+	if buffer[0] != 0x50 || buffer[1] != 0x4b || buffer[2] != 0x03 || buffer[3] != 0x04 {
+		return 0, newZipErrorStr("ReadDir", "couldn't find local file header signature")
+	}
+	if fh.nameLength != binary.LittleEndian.Uint16(buffer[26:28]) {
+		return 0, newZipErrorStr("ReadDir", "local file header doesn't match central directory (filename length)")
+	}
+	return binary.LittleEndian.Uint16(buffer[28:30]), nil
+}
+
+// readLocalOwner returns the UID and GID (16 bits each) from the old Unix extra field in
+// the local header for fh, whose extra field is extraLength bytes long, or nil if the
+// field doesn't have them.
+func (zf *File) readLocalOwner(fh *fileHeader, extraLength uint16) ([]byte, error) {
+	extra := make([]byte, extraLength)
+	err := zf.readAt(extra, int64(fh.offsetLocalHeader)+30+int64(fh.nameLength))
+	if err != nil {
+		return nil, newZipError("ReadDir Read Local Extra Field", err)
+	}
+	data, ok := extraField(extra, EXTRA_UNIX_OLD)
+	if !ok || len(data) < 12 {
+		return nil, nil
+	}
+	return data[8:12], nil
+}
+
 // Display prints out a table of contents for the zip file to the given Writer.
 // The table of contents format is similar to the "unzip -v" command.
 func (zf *File) Display(output io.Writer) {
-	fmt.Printf("Archive: %s\n", zf.Name)
-	if zf.commentLength > 0 {
-		fmt.Printf("Comment: %s\n", zf.comment)
-	}
+	zf.display(output, displayOptions{})
+}
 
-	w := new(tabwriter.Writer)
-	w.Init(output, 8, 0, 1, ' ', tabwriter.AlignRight)
+// DisplayVerified prints out a table of contents like Display, with an extra column
+// showing whether each file's data matches its CRC, like the "unzip -t" command.
+// Files whose CRC doesn't match are marked "BAD CRC", and files that couldn't be
+// checked are marked "ERROR"; in the latter case, DisplayVerified returns the first
+// error it hit after printing the whole table.
+func (zf *File) DisplayVerified(output io.Writer) error {
+	return zf.display(output, displayOptions{verify: true})
+}
 
-	fmt.Fprintln(w, "Length\tMethod\tSize\tCmpr\tDate\tTime\tCRC-32\tName\t")
-	fmt.Fprintln(w, "------\t------\t------\t------\t------\t------\t------\t------\t")
+// DisplayHuman prints out a table of contents like Display, but with the sizes in
+// human-readable units (like 1.2K, 34M, 2.1G) as "ls -h" shows them.
+func (zf *File) DisplayHuman(output io.Writer) {
+	zf.display(output, displayOptions{human: true})
+}
 
-	for _, fh := range zf.fileHeaders {
-		compressedPercent := int(math.Floor(float64(fh.compressedSize) / float64(fh.uncompressedSize) * 100))
-		dt := fh.getDateTime()
-		fmt.Fprintf(w, "%d\t%s\t%d\t%d%%\t%s\t%s\t%x\t%s\t\n",
-			fh.uncompressedSize,
-			compressionMethodToString(CompressionMethod(fh.compressionMethod)),
-			fh.compressedSize,
-			compressedPercent,
-			dt.Format("2006-01-02"),
-			dt.Format("15:04"),
-			fh.crc,
-			fh.fileName)
-	}
-	w.Flush()
+// DisplayComments prints out a table of contents like Display, with each file's
+// comment at the end of its line.
+func (zf *File) DisplayComments(output io.Writer) {
+	zf.display(output, displayOptions{comments: true})
 }
 
-func (zf *File) AddFile(name string, method CompressionMethod) error {
-	if method == COMPRESS_DEFLATED {
-		return errors.New("deflate not implemented")
+// DisplayJSON writes the table of contents to output as a JSON array, with an object
+// for each file holding the same fields that Display shows, plus its comment.
+func (zf *File) DisplayJSON(output io.Writer) error {
+	entries := make([]displayEntry, len(zf.fileHeaders))
+	for i, fh := range zf.fileHeaders {
+		entries[i] = fh.displayEntry(zf.timeLocation())
 	}
-
-	// First open the file...
-	newFile, err := zf.fs.Open(name)
+	err := json.NewEncoder(output).Encode(entries)
 	if err != nil {
-		return err
+		return newZipError("DisplayJSON", err)
 	}
-	defer newFile.Close()
+	return nil
+}
 
-	// Get file info for header
-	info, err := newFile.Stat()
-	if err != nil {
-		return err
-	}
-	uncompressedSize := uint32(info.Size())
-	modTime := info.ModTime()
-	dosDate, dosTime := timeToDosDateTime(modTime)
+// displayEntry holds the fields of a file header as they're shown in the table of
+// contents from Display and DisplayJSON.
+type displayEntry struct {
+	Name             string    `json:"name"`
+	UncompressedSize int64     `json:"uncompressedSize"`
+	CompressedSize   int64     `json:"compressedSize"`
+	Method           string    `json:"method"`
+	CRC32            string    `json:"crc32"`
+	Modified         time.Time `json:"modified"`
+	Comment          string    `json:"comment"`
+}
 
-	crc, err := getCrc(newFile)
-	if err != nil {
-		return err
+func (fh *fileHeader) displayEntry(loc *time.Location) displayEntry {
+	return displayEntry{
+		Name:             fh.fileName,
+		UncompressedSize: int64(fh.uncompressedSize),
+		CompressedSize:   int64(fh.compressedSize),
+		Method:           compressionMethodToString(CompressionMethod(fh.compressionMethod)),
+		CRC32:            fmt.Sprintf("%08x", fh.crc),
+		Modified:         fh.getDateTime(loc),
+		Comment:          fh.comment,
 	}
+}
 
-	// Make a file header. Offsets don't matter yet, but everything else does.
-	newFh := fileHeader{
-		versionMadeBy:      VERSION_MADE_BY,
-		versionNeeded:      VERSION_NEEDED,
-		flags:              FLAGS,
-		compressionMethod:  uint16(method),
-		dosTime:            dosTime,
-		dosDate:            dosDate,
-		crc:                crc,
-		compressedSize:     uncompressedSize,
-		uncompressedSize:   uncompressedSize,
-		nameLength:         uint16(len(name)),
-		extraLengthLocal:   0,
-		extraLengthCentral: 0,
-		commentLength:      0,
-		internalAttr:       INTERNAL_ATTR,
-		externalAttr:       EXTERNAL_ATTR,
-		fileName:           name,
-	}
+// displayOptions says what display shows besides the basic table of contents.
+type displayOptions struct {
+	verify   bool // check each file's CRC and show the result
+	human    bool // show sizes in human-readable units
+	comments bool // show each file's comment
+}
 
-	// Remove fileheader from metadata if it already exists.
-	for i, fh := range zf.fileHeaders {
-		if fh.fileName == name {
-			zf.numEntries--
-			zf.fileHeaders = append(zf.fileHeaders[:i], zf.fileHeaders[i+1:]...)
-			break
+func (zf *File) display(output io.Writer, opts displayOptions) error {
+	size := func(n int64) string {
+		if opts.human {
+			return humanSize(n)
 		}
+		return fmt.Sprintf("%d", n)
 	}
 
-	// Make a temp file to write the new zip contents into
-	outfileTempName := tempName(zf.Name)
-	outfile, err := zf.fs.Create(outfileTempName)
-	if err != nil {
-		return err
+	fmt.Fprintf(output, "Archive: %s\n", zf.Name)
+	if zf.commentLength > 0 {
+		fmt.Fprintf(output, "Comment: %s\n", zf.comment)
 	}
 
-	// Write the updated archive into the temp file
-	zf.numEntries++
-	err = zf.writeArchive(outfile, &newFh, newFile)
-	if err != nil {
-		zf.closeAndDeleteTempFile(outfile, outfileTempName)
-		return err
-	}
+	w := new(tabwriter.Writer)
+	w.Init(output, 8, 0, 1, ' ', tabwriter.AlignRight)
 
-	// Clean-up:
-	// Close zf.file, close temp file,rename the temp file (which deletes the old file),
-	// replace zf.file with the renamed temp file, and reopen it.
-	if zf.file != nil {
-		err = zf.file.Close()
-		if err != nil {
-			zf.closeAndDeleteTempFile(outfile, outfileTempName)
-			return err
-		}
-	}
-	err = zf.closeAndRenameTempFile(outfile, outfileTempName, zf.Name)
-	if err != nil {
-		return err
+	// The comment is left as trailing text after the aligned columns
+	comment := ""
+	if opts.comments {
+		comment = "  Comment"
 	}
-	zf.file, err = zf.fs.Open(zf.Name)
-	if err != nil {
-		return err
+	if opts.verify {
+		fmt.Fprintf(w, "Length\tMethod\tSize\tCmpr\tDate\tTime\tCRC-32\tStatus\tName\t%s\n", comment)
+		fmt.Fprintln(w, "------\t------\t------\t------\t------\t------\t------\t------\t------\t")
+	} else {
+		fmt.Fprintf(w, "Length\tMethod\tSize\tCmpr\tDate\tTime\tCRC-32\tName\t%s\n", comment)
+		fmt.Fprintln(w, "------\t------\t------\t------\t------\t------\t------\t------\t")
 	}
 
-	return nil
-}
-
-func (zf *File) RemoveFile(name string) error {
-	// Remove the fileheader from the metadata
-	foundFh := false
+	var firstErr error
 	for i, fh := range zf.fileHeaders {
-		if fh.fileName == name {
-			foundFh = true
-			zf.numEntries--
-			zf.fileHeaders = append(zf.fileHeaders[:i], zf.fileHeaders[i+1:]...)
-			break
+		de := fh.displayEntry(zf.timeLocation())
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d%%\t%s\t%s\t%s\t",
+			size(de.UncompressedSize),
+			de.Method,
+			size(de.CompressedSize),
+			compressedPercent(de.CompressedSize, de.UncompressedSize),
+			de.Modified.Format("2006-01-02"),
+			de.Modified.Format("15:04"),
+			de.CRC32)
+		if opts.verify {
+			crc, err := zf.fileCrc(context.Background(), &zf.fileHeaders[i])
+			if err != nil {
+				fmt.Fprint(w, "ERROR\t")
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else if !fh.crcMatches(crc) {
+				fmt.Fprint(w, "BAD CRC\t")
+			} else {
+				fmt.Fprint(w, "OK\t")
+			}
+		}
+		if opts.comments && de.Comment != "" {
+			fmt.Fprintf(w, "%s\t  %s\n", de.Name, de.Comment)
+		} else {
+			fmt.Fprintf(w, "%s\t\n", de.Name)
 		}
-	}
-	if !foundFh {
-		return nil // Let's not return an error if the archive doesn't have the file?
 	}
 
-	// Make a temp file to write the new zip contents into
-	outfileTempName := tempName(zf.Name)
-	outfile, err := zf.fs.Create(outfileTempName)
-	if err != nil {
-		return err
+	// Footer with the totals for the whole archive
+	status := ""
+	if opts.verify {
+		status = "\t"
 	}
-
-	// Write the updated archive into the temp file
-	err = zf.writeArchive(outfile, nil, nil)
-	if err != nil {
-		zf.closeAndDeleteTempFile(outfile, outfileTempName)
-		return err
+	files := "files"
+	if len(zf.fileHeaders) == 1 {
+		files = "file"
 	}
+	fmt.Fprintf(w, "------\t\t------\t------\t\t\t\t%s------\t\n", status)
+	fmt.Fprintf(w, "%s\t\t%s\t%d%%\t\t\t\t%s%d %s\t\n",
+		size(zf.TotalUncompressedSize()),
+		size(zf.TotalCompressedSize()),
+		compressedPercent(zf.TotalCompressedSize(), zf.TotalUncompressedSize()),
+		status,
+		len(zf.fileHeaders),
+		files)
+	w.Flush()
+	return firstErr
+}
 
-	// Clean-up:
-	// Close zf.file, close temp file,rename the temp file (which deletes the old file),
-	// replace zf.file with the renamed temp file, and reopen it.
-	err = zf.file.Close()
-	if err != nil {
-		zf.closeAndDeleteTempFile(outfile, outfileTempName)
-		return err
+// humanSize formats a size in bytes like "ls -h": sizes under 1K are printed as is,
+// and larger ones are rounded up to one decimal place if they're under 10 of their
+// unit, or to a whole number otherwise.
+func humanSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d", n)
 	}
-	err = zf.closeAndRenameTempFile(outfile, outfileTempName, zf.Name)
-	if err != nil {
-		return err
+	const units = "KMGTPE"
+	value := float64(n) / 1024
+	for i := 0; ; i++ {
+		if tenths := math.Ceil(value * 10); tenths < 100 {
+			return fmt.Sprintf("%.1f%c", tenths/10, units[i])
+		}
+		if whole := math.Ceil(value); whole < 1024 || i == len(units)-1 {
+			return fmt.Sprintf("%.0f%c", whole, units[i])
+		}
+		value /= 1024
 	}
-	zf.file, err = zf.fs.Open(zf.Name)
-	if err != nil {
-		return err
+}
+
+// compressedPercent returns the compressed size as a percentage of the uncompressed
+// size, rounded down. Empty files count as 0%.
+func compressedPercent(compressed int64, uncompressed int64) int {
+	if uncompressed == 0 {
+		return 0
 	}
+	return int(math.Floor(float64(compressed) / float64(uncompressed) * 100))
+}
 
-	return nil
+// List returns the entries in the archive, in central directory order.
+// If SetPreferLastDuplicate is on, files that are shadowed by a later file with the
+// same name are left out.
+func (zf *File) List() []Entry {
+	entries := make([]Entry, 0, len(zf.fileHeaders))
+	zf.ForEach(func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries
 }
 
-func (zf *File) ExtractFile(name string) error {
-	for _, fh := range zf.fileHeaders {
-		if fh.fileName == name {
-			return zf.extractSingleFile(&fh)
+// ForEach calls fn for each entry in the archive, in the same order as List. It stops
+// as soon as fn returns an error, and returns that error.
+func (zf *File) ForEach(fn func(e Entry) error) error {
+	last := map[string]int{}
+	if zf.preferLastDuplicate {
+		for i, fh := range zf.fileHeaders {
+			last[fh.fileName] = i
 		}
 	}
-	return errors.New("file not found")
-}
 
-func (zf *File) ExtractAll() error {
-	for _, fh := range zf.fileHeaders {
-		err := zf.extractSingleFile(&fh)
+	for i, fh := range zf.fileHeaders {
+		if zf.preferLastDuplicate && last[fh.fileName] != i {
+			continue
+		}
+		err := fn(fh.entry(zf.timeLocation()))
 		if err != nil {
 			return err
 		}
@@ -412,53 +823,1401 @@ func (zf *File) ExtractAll() error {
 	return nil
 }
 
-func (zf *File) extractSingleFile(fh *fileHeader) error {
-	if fh.compressionMethod == COMPRESS_DEFLATED {
-		return errors.New("deflate not implemented")
+// Names returns the names of the files in the archive, in the same order as List.
+func (zf *File) Names() []string {
+	entries := zf.List()
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
 	}
+	return names
+}
 
-	// read extra field length so that we can seek to the file data
-	_, err := zf.file.Seek(int64(fh.offsetLocalHeader+28), io.SeekStart)
-	if err != nil {
-		return err
+// Contains returns whether the archive has a file with the given name.
+func (zf *File) Contains(name string) bool {
+	return zf.findFileHeader(name) >= 0
+}
+
+// GetEntry returns the metadata of the file with the given name in the archive, and
+// whether the archive has the file. Like List, it returns a copy.
+func (zf *File) GetEntry(name string) (Entry, bool) {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return Entry{}, false
 	}
-	var extraFieldLength uint16
-	err = binary.Read(zf.file, binary.LittleEndian, &extraFieldLength)
+	return zf.fileHeaders[i].entry(zf.timeLocation()), true
+}
+
+// HasEncryptedEntries returns whether any file in the archive is encrypted.
+func (zf *File) HasEncryptedEntries() bool {
+	for _, fh := range zf.fileHeaders {
+		if fh.flags&FLAG_ENCRYPTED != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NumEntries returns the number of entries in the archive's central directory.
+func (zf *File) NumEntries() int {
+	return len(zf.fileHeaders)
+}
+
+// TotalCompressedSize returns the sum of the compressed sizes of every entry in the
+// archive.
+func (zf *File) TotalCompressedSize() int64 {
+	var total int64
+	for _, fh := range zf.fileHeaders {
+		total += int64(fh.compressedSize)
+	}
+	return total
+}
+
+// TotalUncompressedSize returns the sum of the uncompressed sizes of every entry in
+// the archive, which is how much space extracting it takes.
+func (zf *File) TotalUncompressedSize() int64 {
+	var total int64
+	for _, fh := range zf.fileHeaders {
+		total += int64(fh.uncompressedSize)
+	}
+	return total
+}
+
+// Methods returns the compression methods used in the archive, each one once, in the
+// order that they first appear. This is for checking up front whether the archive has
+// files that can't be read. Files encrypted with WinZip AES have COMPRESS_AES.
+func (zf *File) Methods() []CompressionMethod {
+	methods := []CompressionMethod{}
+	for _, fh := range zf.fileHeaders {
+		method := CompressionMethod(fh.compressionMethod)
+		if !slices.Contains(methods, method) {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// SetLocation sets the time zone that the archive's DOS modification times are in,
+// which is used both to read them and to store new ones. DOS times don't say what time
+// zone they're in, so by default they're assumed to be in time.Local. Use time.UTC so
+// that archives made on machines in different time zones come out the same.
+func (zf *File) SetLocation(loc *time.Location) {
+	zf.location = loc
+}
+
+// SetRestoreOwner sets whether extracting a file sets its owner to the UID and GID
+// from its Unix extra field, when it has one. It's off by default, since it usually
+// needs the extracting process to be privileged.
+func (zf *File) SetRestoreOwner(restore bool) {
+	zf.restoreOwner = restore
+}
+
+// SetPassword sets the password for reading files encrypted with WinZip AES, so that
+// ReadFile, OpenEntry, and the Extract and Verify methods decrypt them. Without a
+// password, or for files with traditional ZipCrypto encryption, they return
+// ErrEncrypted, and they return ErrBadPassword if the password is wrong.
+func (zf *File) SetPassword(password string) {
+	zf.password = password
+}
+
+// timeLocation returns the time zone of the archive's DOS times.
+func (zf *File) timeLocation() *time.Location {
+	if zf.location == nil {
+		return time.Local
+	}
+	return zf.location
+}
+
+// SetPreferLastDuplicate sets which file wins when the archive has several files with
+// the same name (which happens when updates are appended to an archive). By default,
+// the first one wins; if preferLast is true, the last one (usually the newest) wins
+// instead. This affects ExtractFile, List, FileComment, and SetFileComment.
+func (zf *File) SetPreferLastDuplicate(preferLast bool) {
+	zf.preferLastDuplicate = preferLast
+}
+
+// findFileHeader returns the index in zf.fileHeaders of the file with the given name,
+// or -1 if there isn't one. Duplicate names are resolved by SetPreferLastDuplicate.
+func (zf *File) findFileHeader(name string) int {
+	if zf.preferLastDuplicate {
+		for i := len(zf.fileHeaders) - 1; i >= 0; i-- {
+			if zf.fileHeaders[i].fileName == name {
+				return i
+			}
+		}
+		return -1
+	}
+	for i, fh := range zf.fileHeaders {
+		if fh.fileName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// FileComment returns the comment on the file with the given name in the archive.
+func (zf *File) FileComment(name string) (string, error) {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return "", newZipError("FileComment", ErrFileNotFound)
+	}
+	return zf.fileHeaders[i].comment, nil
+}
+
+// SetFileComment sets the comment on the file with the given name in the archive.
+// The change is written to disk the next time the archive is rewritten (e.g. by Save).
+func (zf *File) SetFileComment(name string, comment string) error {
+	err := zf.checkWritable("SetFileComment")
+	if err != nil {
+		return err
+	}
+	return setFileComment(zf.fileHeaders, zf.findFileHeader(name), comment)
+}
+
+// Comment returns the archive's comment.
+func (zf *File) Comment() string {
+	return string(zf.comment)
+}
+
+// SetArchiveComment sets the archive's comment. Like SetFileComment, the change is
+// written to disk the next time the archive is rewritten (e.g. by Save).
+func (zf *File) SetArchiveComment(comment string) error {
+	err := zf.checkWritable("SetArchiveComment")
+	if err != nil {
+		return err
+	}
+	if len(comment) > math.MaxUint16 {
+		return newZipErrorStr("SetArchiveComment", "comment is longer than 65535 bytes")
+	}
+	zf.comment = []byte(comment)
+	zf.commentLength = uint16(len(comment))
+	return nil
+}
+
+// setFileComment sets the comment on headers[i]. i is -1 if the file wasn't found.
+func setFileComment(headers []fileHeader, i int, comment string) error {
+	if len(comment) > math.MaxUint16 {
+		return newZipErrorStr("SetFileComment", "comment is longer than 65535 bytes")
+	}
+	if i < 0 {
+		return newZipError("SetFileComment", ErrFileNotFound)
+	}
+	headers[i].comment = comment
+	headers[i].commentLength = uint16(len(comment))
+	return nil
+}
+
+// AddFile adds the file with the given name to the archive, replacing any file
+// in the archive with the same name (in the same place in the archive's order, so
+// the other files don't move). The name is stored cleaned up, with "/" as the
+// separator and without a leading "./" or "/"; names that would be outside the
+// archive, like "../x.txt", return ErrInsecurePath.
+func (zf *File) AddFile(name string, method CompressionMethod) error {
+	b := zf.Batch()
+	err := b.AddFile(name, method)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// AddFileStrict is like AddFile, but it returns ErrDuplicateName instead of replacing
+// a file in the archive with the same name, and leaves the archive untouched.
+func (zf *File) AddFileStrict(name string, method CompressionMethod) error {
+	b := zf.Batch()
+	err := b.AddFileStrict(name, method)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// AddFileWithOptions is like AddFile, but the file is stored as opts says. A Level of
+// 0 is flate.DefaultCompression (the level that AddFile uses), not flate.NoCompression;
+// use LEVEL_NO_COMPRESSION to deflate without compressing.
+func (zf *File) AddFileWithOptions(name string, opts AddOptions) error {
+	b := zf.Batch()
+	err := b.AddFileWithOptions(name, opts)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// AddFileDefault is like AddFile, but the file is stored with the compression method
+// and level from CreateArchive's options. For an archive that wasn't made by
+// CreateArchive, files are stored without compression.
+func (zf *File) AddFileDefault(name string) error {
+	return zf.AddFileWithOptions(name, zf.defaults)
+}
+
+// AddFileAs adds the file at sourcePath to the archive as a file named entryName,
+// replacing any file in the archive with that name. For example,
+// AddFileAs(path, filepath.Base(path), method) stores the file without its directory.
+func (zf *File) AddFileAs(sourcePath string, entryName string, method CompressionMethod) error {
+	b := zf.Batch()
+	err := b.AddFileAs(sourcePath, entryName, method)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// AddFileWithTime is like AddFile, but the file is stored with the modification time
+// modTime instead of the time it was last modified on disk, so that the archive
+// doesn't depend on when the file was written.
+func (zf *File) AddFileWithTime(name string, method CompressionMethod, modTime time.Time) error {
+	b := zf.Batch()
+	err := b.AddFileWithTime(name, method, modTime)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// AddFileContext is like AddFile, but it stops with ctx's error if ctx is done before
+// the archive is rewritten. The archive is left as it was.
+func (zf *File) AddFileContext(ctx context.Context, name string, method CompressionMethod) error {
+	b := zf.Batch()
+	err := b.AddFile(name, method)
+	if err != nil {
+		return err
+	}
+	return b.CommitContext(ctx)
+}
+
+// AddReader adds the data read from r to the archive as a file with the given name,
+// replacing any file in the archive with the same name. The data is buffered in memory.
+func (zf *File) AddReader(name string, r io.Reader, method CompressionMethod) error {
+	b := zf.Batch()
+	err := b.AddReader(name, r, method)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// AddBytes adds data to the archive as a file with the given name, replacing any
+// file in the archive with the same name.
+func (zf *File) AddBytes(name string, data []byte, method CompressionMethod) error {
+	return zf.AddReader(name, bytes.NewReader(data), method)
+}
+
+// UpdateFile replaces the contents of the file with the given name in the archive with
+// the data read from r, keeping its place in the archive and its comment. It returns
+// ErrFileNotFound if the archive doesn't have the file.
+func (zf *File) UpdateFile(name string, r io.Reader, method CompressionMethod) error {
+	b := zf.Batch()
+	err := b.UpdateFile(name, r, method)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// RenameEntry renames the file named oldName in the archive to newName, which is
+// cleaned up like AddFile's names. The file's data is copied as it is, without being
+// decompressed. It returns ErrFileNotFound if the archive doesn't have oldName,
+// ErrInsecurePath if newName would be outside the archive, or ErrDuplicateName if it
+// already has newName.
+func (zf *File) RenameEntry(oldName string, newName string) error {
+	b := zf.Batch()
+	err := b.RenameEntry(oldName, newName)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// Merge copies every file in other into the archive, with its data as it's stored in
+// other (without decompressing and recompressing it). onConflict says what to do with
+// files whose names are already in the archive. The merged archive has no comment; use
+// MergeWithOptions to keep or combine the comments. other must stay open until Merge
+// returns.
+func (zf *File) Merge(other *File, onConflict ConflictPolicy) error {
+	return zf.MergeWithOptions(other, MergeOptions{OnConflict: onConflict})
+}
+
+// MergeWithOptions is like Merge, with opts saying what to do with conflicting files
+// and what the merged archive's comment is. If it fails, the archive (and its comment)
+// is left as it was.
+func (zf *File) MergeWithOptions(other *File, opts MergeOptions) error {
+	comment, err := opts.mergedComment(zf, other)
+	if err != nil {
+		return newZipError("Merge", err)
+	}
+	if len(comment) > math.MaxUint16 {
+		return newZipErrorStr("Merge", "comment is longer than 65535 bytes")
+	}
+	b := zf.Batch()
+	for i := range other.fileHeaders {
+		fh := other.copiedHeader(&other.fileHeaders[i])
+		if b.find(fh.fileName) >= 0 {
+			switch opts.OnConflict {
+			case CONFLICT_SKIP:
+				continue
+			case CONFLICT_ERROR:
+				return newZipError("Merge", ErrDuplicateName)
+			}
+		}
+		b.put(fh)
+	}
+
+	// The comment is written with the rewritten archive, so restore the old one if that
+	// fails
+	oldComment, oldLength := zf.comment, zf.commentLength
+	zf.comment, zf.commentLength = []byte(comment), uint16(len(comment))
+	err = b.Commit()
+	if err != nil {
+		zf.comment, zf.commentLength = oldComment, oldLength
+	}
+	return err
+}
+
+// CopyEntryFrom copies the file with the given name from src into the archive, with
+// its data as it's stored in src (without decompressing and recompressing it), and
+// the same compression method, CRC, and timestamps. It replaces any file in the
+// archive with the same name. It returns ErrFileNotFound if src doesn't have the file.
+func (zf *File) CopyEntryFrom(src *File, name string) error {
+	b := zf.Batch()
+	err := b.CopyEntryFrom(src, name)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// copiedHeader returns a copy of fh whose data is read from zf, for copying the file
+// into another archive.
+func (zf *File) copiedHeader(fh *fileHeader) fileHeader {
+	copied := *fh
+	copied.raw = true
+	copied.source = func() (io.ReadCloser, error) {
+		fileData, err := zf.rawFileData(fh)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(fileData), nil
+	}
+	return copied
+}
+
+// Optimize recompresses every file in the archive with the given method, keeping its
+// name, comment, and timestamps, and rewrites the archive once. Directories and
+// encrypted files are kept as they are. Each file's CRC is checked as it's
+// decompressed, so a corrupt file stops Optimize with the archive left as it was.
+func (zf *File) Optimize(method CompressionMethod) error {
+	err := checkWriteMethod("Optimize", method)
+	if err != nil {
+		return err
+	}
+	err = zf.checkWritable("Optimize")
+	if err != nil {
+		return err
+	}
+
+	headers := slices.Clone(zf.fileHeaders)
+	for i := range headers {
+		fh := &zf.fileHeaders[i]
+		if strings.HasSuffix(fh.fileName, "/") || fh.flags&FLAG_ENCRYPTED != 0 {
+			continue
+		}
+		headers[i].compressionMethod = uint16(method)
+		headers[i].flags &^= FLAG_DEFLATE_OPTIONS
+		headers[i].compressedSize = fh.uncompressedSize
+		headers[i].level = flate.DefaultCompression
+		headers[i].source = func() (io.ReadCloser, error) {
+			fileData, err := zf.openFileData(fh)
+			if err != nil {
+				return nil, err
+			}
+			return &entryFile{fh: *fh, loc: zf.timeLocation(), r: fileData, crc: crc32.NewIEEE()}, nil
+		}
+	}
+	return zf.rewriteArchive(context.Background(), headers)
+}
+
+// AddDir adds the directory tree rooted at root to the archive. Each file and
+// directory under root is stored with a name relative to root (using "/" as the
+// separator), replacing any file in the archive with the same name. The archive
+// is only rewritten once, after the whole tree has been walked.
+func (zf *File) AddDir(root string, method CompressionMethod) error {
+	err := checkWriteMethod("AddDir", method)
+	if err != nil {
+		return err
+	}
+	err = zf.checkWritable("AddDir")
+	if err != nil {
+		return err
+	}
+
+	b := zf.Batch()
+	err = b.AddDir(root, method)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// newFileHeader makes a file header for the file at path on zf.fs, to be stored in
+// the archive as name (cleaned up by entryName). Offsets don't matter yet, but
+// everything else does. The header's source reopens the file when the archive is
+// written.
+func (zf *File) newFileHeader(path string, name string, method CompressionMethod) (fileHeader, error) {
+	err := checkWriteMethod("AddFile", method)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	err = zf.checkWritable("AddFile")
+	if err != nil {
+		return fileHeader{}, err
+	}
+	name, err = entryName(name)
+	if err != nil {
+		return fileHeader{}, newZipError("AddFile", err)
+	}
+
+	// First open the file...
+	newFile, err := zf.fs.Open(path)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	defer newFile.Close()
+
+	// Get file info for header
+	info, err := newFile.Stat()
+	if err != nil {
+		return fileHeader{}, err
+	}
+
+	crc, text, err := getCrc(newFile)
+	if err != nil {
+		return fileHeader{}, err
+	}
+
+	fh := newHeader(name, method, info.ModTime().In(zf.timeLocation()), crc, uint32(info.Size()))
+	fh.internalAttr = textAttr(text)
+	fh.setUnixMode(S_IFREG, info.Mode())
+	fh.source = func() (io.ReadCloser, error) {
+		return zf.fs.Open(path)
+	}
+	return fh, nil
+}
+
+// newReaderHeader makes a file header for the data read from r, to be stored in the
+// archive as name (cleaned up by entryName). The data is buffered in memory until the
+// archive is written.
+func (zf *File) newReaderHeader(name string, r io.Reader, method CompressionMethod) (fileHeader, error) {
+	err := checkWriteMethod("AddReader", method)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	name, err = entryName(name)
+	if err != nil {
+		return fileHeader{}, newZipError("AddReader", err)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fileHeader{}, err
+	}
+
+	fh := newHeader(name, method, time.Now().In(zf.timeLocation()), crc32.ChecksumIEEE(data), uint32(len(data)))
+	text := &textDetector{}
+	text.Write(data)
+	fh.internalAttr = textAttr(text.isText())
+	fh.source = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return fh, nil
+}
+
+// newHeader makes a file header for a new file with the given name and properties.
+// Offsets don't matter yet, but everything else does. The caller sets its source.
+func newHeader(name string, method CompressionMethod, modTime time.Time, crc uint32, uncompressedSize uint32) fileHeader {
+	dosDate, dosTime := timeToDosDateTime(modTime)
+	fh := fileHeader{
+		versionMadeBy:      VERSION_MADE_BY,
+		versionNeeded:      VERSION_NEEDED,
+		flags:              FLAGS,
+		compressionMethod:  uint16(method),
+		dosTime:            dosTime,
+		dosDate:            dosDate,
+		crc:                crc,
+		compressedSize:     uncompressedSize,
+		uncompressedSize:   uncompressedSize,
+		nameLength:         uint16(len(name)),
+		extraLengthLocal:   0,
+		extraLengthCentral: 0,
+		commentLength:      0,
+		internalAttr:       INTERNAL_ATTR,
+		externalAttr:       EXTERNAL_ATTR,
+		fileName:           name,
+		level:              flate.DefaultCompression,
+	}
+	if !isASCII(name) {
+		fh.flags |= FLAG_UTF8
+	}
+	return fh
+}
+
+// newDirHeader makes a file header for a directory entry with the given name,
+// which should end in "/". Directory entries have no data.
+func newDirHeader(name string, modTime time.Time) fileHeader {
+	fh := newHeader(name, COMPRESS_STORED, modTime, 0, 0)
+	fh.externalAttr = EXTERNAL_ATTR_DIR
+	fh.source = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return fh
+}
+
+// RemoveFile removes the file with the given name from the archive. It returns
+// ErrFileNotFound if the archive doesn't have the file.
+func (zf *File) RemoveFile(name string) error {
+	b := zf.Batch()
+	if !b.remove(name) {
+		return newZipError("RemoveFile", ErrFileNotFound)
+	}
+	return b.Commit()
+}
+
+// RemoveFileIfExists removes the file with the given name from the archive, like
+// RemoveFile, but it doesn't return an error if the archive doesn't have the file.
+func (zf *File) RemoveFileIfExists(name string) error {
+	err := zf.RemoveFile(name)
+	if errors.Is(err, ErrFileNotFound) {
+		return nil
+	}
+	return err
+}
+
+// RemoveFiles removes the files with the given names from the archive, rewriting
+// the archive only once. It returns the names that weren't in the archive.
+func (zf *File) RemoveFiles(names []string) ([]string, error) {
+	b := zf.Batch()
+	missing := []string{}
+	for _, name := range names {
+		if !b.remove(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == len(names) {
+		return missing, nil // Nothing changed, so there's nothing to rewrite
+	}
+
+	return missing, b.Commit()
+}
+
+// FindDuplicates returns the names of the files in the archive that have the same
+// contents, in groups of two or more names, in the order that they appear in the
+// archive. Files whose CRC and size match are read to make sure that their contents
+// really are the same. Directories, empty files, and encrypted files are left out.
+func (zf *File) FindDuplicates() ([][]string, error) {
+	groups, err := zf.duplicateGroups()
+	if err != nil {
+		return nil, newZipError("FindDuplicates", err)
+	}
+	names := [][]string{}
+	for _, group := range groups {
+		names = append(names, []string{})
+		for _, i := range group {
+			names[len(names)-1] = append(names[len(names)-1], zf.fileHeaders[i].fileName)
+		}
+	}
+	return names, nil
+}
+
+// Deduplicate removes every file in the archive that has the same contents as a file
+// before it (see FindDuplicates), rewriting the archive once, and returns how many
+// files were removed.
+func (zf *File) Deduplicate() (int, error) {
+	groups, err := zf.duplicateGroups()
+	if err != nil {
+		return 0, newZipError("Deduplicate", err)
+	}
+	// Remove the duplicates by index rather than by name, since the archive may have
+	// more than one file with the same name
+	remove := map[int]bool{}
+	for _, group := range groups {
+		for _, i := range group[1:] {
+			remove[i] = true
+		}
+	}
+	if len(remove) == 0 {
+		return 0, nil // Nothing changed, so there's nothing to rewrite
+	}
+	headers := []fileHeader{}
+	for i, fh := range zf.fileHeaders {
+		if !remove[i] {
+			headers = append(headers, fh)
+		}
+	}
+	if err := zf.rewriteArchive(context.Background(), headers); err != nil {
+		return 0, err
+	}
+	return len(remove), nil
+}
+
+// duplicateGroups returns the indexes in zf.fileHeaders of the files that have the
+// same contents, grouped as described by FindDuplicates.
+func (zf *File) duplicateGroups() ([][]int, error) {
+	type key struct {
+		crc  uint32
+		size uint32
+	}
+	keys := []key{}
+	candidates := map[key][]int{}
+	for i := range zf.fileHeaders {
+		fh := &zf.fileHeaders[i]
+		if fh.uncompressedSize == 0 || strings.HasSuffix(fh.fileName, "/") || fh.flags&FLAG_ENCRYPTED != 0 {
+			continue
+		}
+		k := key{fh.crc, fh.uncompressedSize}
+		if candidates[k] == nil {
+			keys = append(keys, k)
+		}
+		candidates[k] = append(candidates[k], i)
+	}
+
+	groups := [][]int{}
+	for _, k := range keys {
+		if len(candidates[k]) < 2 {
+			continue
+		}
+		contents := [][]byte{}
+		indexes := [][]int{}
+		for _, i := range candidates[k] {
+			data, err := zf.readFileData(&zf.fileHeaders[i])
+			if err != nil {
+				return nil, err
+			}
+			j := slices.IndexFunc(contents, func(c []byte) bool {
+				return bytes.Equal(c, data)
+			})
+			if j < 0 {
+				contents = append(contents, data)
+				indexes = append(indexes, []int{i})
+			} else {
+				indexes[j] = append(indexes[j], i)
+			}
+		}
+		for _, group := range indexes {
+			if len(group) > 1 {
+				groups = append(groups, group)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// Save rewrites the archive so that pending changes to its metadata (such as
+// comments) are written to disk. It's safe to call even if nothing changed.
+func (zf *File) Save() error {
+	return zf.rewriteArchive(context.Background(), zf.fileHeaders)
+}
+
+// WriteStream writes the archive, with any changes from SetFileComment, to w as a
+// stream: each file's CRC and sizes go in a data descriptor after its data, so w never
+// needs to seek. The archive on disk isn't changed.
+func (zf *File) WriteStream(w io.Writer) error {
+	_, _, _, err := zf.writeArchive(context.Background(), w, zf.fileHeaders, true)
+	if err != nil {
+		return newZipError("WriteStream", err)
+	}
+	return nil
+}
+
+// WriteTo writes the archive, with any changes from SetFileComment, to w, and returns
+// the number of bytes written. The archive is written just as Save would write it,
+// with each file's CRC and sizes in its local header (which w doesn't need to seek
+// for). The archive on disk isn't changed.
+func (zf *File) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	_, _, _, err := zf.writeArchive(context.Background(), cw, zf.fileHeaders, false)
+	if err != nil {
+		return cw.n, newZipError("WriteTo", err)
+	}
+	return cw.n, nil
+}
+
+// Clone copies the archive byte for byte to a new file named newName on the same file
+// system, replacing any file with that name, and returns a File open on the copy with
+// the same options (like SetLocation and SetPassword). Nothing is decompressed. The
+// copy doesn't have changes that haven't been saved yet (see Save).
+func (zf *File) Clone(newName string) (*File, error) {
+	err := zf.checkWritable("Clone")
+	if err != nil {
+		return nil, err
+	}
+
+	outfile, outfileTempName, err := zf.createArchiveTempFile(newName)
+	if err != nil {
+		return nil, newZipError("Clone", err)
+	}
+	_, err = io.Copy(outfile, io.NewSectionReader(zf.r, 0, zf.size))
+	if err != nil {
+		closeAndDeleteTempFile(zf.fs, outfile, outfileTempName)
+		return nil, newZipError("Clone", err)
+	}
+	err = closeAndRenameTempFile(zf.fs, outfile, outfileTempName, newName)
+	if err != nil {
+		return nil, newZipError("Clone", err)
+	}
+
+	clone, err := OpenWithFs(newName, zf.fs)
+	if err != nil {
+		return nil, err
+	}
+	clone.preferLastDuplicate = zf.preferLastDuplicate
+	clone.location = zf.location
+	clone.restoreOwner = zf.restoreOwner
+	clone.password = zf.password
+	clone.defaults = zf.defaults
+	return clone, nil
+}
+
+// rewriteArchive writes an archive with the given file headers into a temp file,
+// then replaces the archive with it. zf.fileHeaders is only updated if this succeeds.
+func (zf *File) rewriteArchive(ctx context.Context, headers []fileHeader) error {
+	err := zf.checkWritable("Save")
+	if err != nil {
+		return err
+	}
+
+	// Make a temp file to write the new zip contents into
+	outfile, outfileTempName, err := zf.createArchiveTempFile(zf.Name)
+	if err != nil {
+		return err
+	}
+
+	// Write the updated archive into the temp file
+	headers, centralDirOffset, centralDirSize, err := zf.writeArchive(ctx, outfile, headers, false)
+	if err != nil {
+		closeAndDeleteTempFile(zf.fs, outfile, outfileTempName)
+		return err
+	}
+
+	// Clean-up:
+	// Close zf.file, close temp file,rename the temp file (which deletes the old file),
+	// replace zf.file with the renamed temp file, and reopen it. Nothing reads the
+	// archive between closing zf.file and reopening it.
+	if zf.file != nil {
+		err = zf.file.Close()
+		if err != nil {
+			closeAndDeleteTempFile(zf.fs, outfile, outfileTempName)
+			return err
+		}
+		zf.file = nil
+	}
+	err = closeAndRenameTempFile(zf.fs, outfile, outfileTempName, zf.Name)
+	if err != nil {
+		// The old archive is still there, so go back to reading it rather than leaving
+		// zf with a closed file. (A new archive has nothing to reopen.)
+		zf.fs.Remove(outfileTempName)
+		if zf.r != nil {
+			zf.openArchiveFile()
+		}
+		return err
+	}
+	zf.fileHeaders = headers
+	zf.numEntries = uint16(len(headers))
+	zf.centralDirOffset = centralDirOffset
+	zf.centralDirSize = centralDirSize
+	zf.lazy = false // We know every local header now, since we just wrote them
+	return zf.openArchiveFile()
+}
+
+// ExtractFile extracts the named file into the current working directory, creating
+// any parent directories of the file as needed. It returns ErrInsecurePath if the
+// file's name would put it outside the directory.
+func (zf *File) ExtractFile(name string) error {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return newZipError("ExtractFile", ErrFileNotFound)
+	}
+	return zf.extractHere(context.Background(), &zf.fileHeaders[i], extractHooks{})
+}
+
+// ExtractFileN is like ExtractFile, but it also returns the number of uncompressed bytes
+// written, which is how much was written before the error if there is one.
+func (zf *File) ExtractFileN(name string) (int64, error) {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return 0, newZipError("ExtractFileN", ErrFileNotFound)
+	}
+	var n int64
+	err := zf.extractHere(context.Background(), &zf.fileHeaders[i], extractHooks{progress: func(written int64) {
+		n += written
+	}})
+	return n, err
+}
+
+// ReadFile returns the contents of the file with the given name in the archive,
+// checking its CRC. Nothing is written to disk.
+func (zf *File) ReadFile(name string) ([]byte, error) {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return nil, newZipError("ReadFile", ErrFileNotFound)
+	}
+	data, err := zf.readFileData(&zf.fileHeaders[i])
+	if err != nil {
+		return nil, newZipError("ReadFile", err)
+	}
+	return data, nil
+}
+
+// ReadAll returns the contents of every file in the archive, keyed by name, checking
+// their CRCs. Directories are left out. Nothing is written to disk.
+func (zf *File) ReadAll() (map[string][]byte, error) {
+	contents := map[string][]byte{}
+	for i := range zf.fileHeaders {
+		fh := &zf.fileHeaders[i]
+		if strings.HasSuffix(fh.fileName, "/") {
+			continue
+		}
+		data, err := zf.readFileData(fh)
+		if err != nil {
+			return nil, newZipError("ReadAll "+fh.fileName, err)
+		}
+		contents[fh.fileName] = data
+	}
+	return contents, nil
+}
+
+// readFileData returns the decompressed data of the file with the given header,
+// checking its CRC.
+func (zf *File) readFileData(fh *fileHeader) ([]byte, error) {
+	fileData, err := zf.openFileData(fh)
+	if err != nil {
+		return nil, err
+	}
+	defer fileData.Close()
+	data, err := io.ReadAll(fileData)
+	if err != nil {
+		return nil, err
+	}
+	if !fh.crcMatches(crc32.ChecksumIEEE(data)) {
+		return nil, fmt.Errorf("CRC mismatch in %s", fh.fileName)
+	}
+	return data, nil
+}
+
+// WriteFileTo writes the contents of the file with the given name in the archive to w,
+// checking its CRC as it goes, and returns the number of bytes written. Nothing is
+// written to disk. If the CRC doesn't match, the data has already been written to w
+// when the error is returned.
+func (zf *File) WriteFileTo(name string, w io.Writer) (int64, error) {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return 0, newZipError("WriteFileTo", ErrFileNotFound)
+	}
+	fh := &zf.fileHeaders[i]
+	fileData, err := zf.openFileData(fh)
+	if err != nil {
+		return 0, newZipError("WriteFileTo", err)
+	}
+	defer fileData.Close()
+	hash := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, hash), fileData)
+	if err != nil {
+		return n, newZipError("WriteFileTo", err)
+	}
+	if !fh.crcMatches(hash.Sum32()) {
+		return n, newZipErrorStr("WriteFileTo", fmt.Sprintf("CRC mismatch in %s", fh.fileName))
+	}
+	return n, nil
+}
+
+// ExtractAll extracts every file in the archive into the current working directory.
+// It stops without extracting anything more at a file whose name would put it outside
+// the directory.
+func (zf *File) ExtractAll() error {
+	return zf.ExtractAllContext(context.Background())
+}
+
+// ExtractAllN is like ExtractAll, but it also returns the total number of uncompressed
+// bytes written, which is how much was written before the error if there is one.
+func (zf *File) ExtractAllN() (int64, error) {
+	var n int64
+	for _, fh := range zf.fileHeaders {
+		err := zf.extractHere(context.Background(), &fh, extractHooks{progress: func(written int64) {
+			n += written
+		}})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ExtractFileTo extracts the named file into the directory dir instead of the current
+// working directory, creating dir and any parent directories of the file as needed.
+func (zf *File) ExtractFileTo(name string, dir string) error {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return newZipError("ExtractFileTo", ErrFileNotFound)
+	}
+	dest, err := extractPath(dir, name)
+	if err != nil {
+		return newZipError("ExtractFileTo", err)
+	}
+	return zf.extractSingleFile(context.Background(), &zf.fileHeaders[i], dest, extractHooks{})
+}
+
+// ExtractAllTo extracts every file in the archive into the directory dir instead of
+// the current working directory, creating dir as needed. It stops without extracting
+// anything more at a file whose name would put it outside dir.
+func (zf *File) ExtractAllTo(dir string) error {
+	for _, fh := range zf.fileHeaders {
+		dest, err := extractPath(dir, fh.fileName)
+		if err != nil {
+			return newZipError("ExtractAllTo", err)
+		}
+		err = zf.extractSingleFile(context.Background(), &fh, dest, extractHooks{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractFileToFs is like ExtractFileTo, but it extracts the file into dir on dst
+// instead of the file system that the archive lives on. It works for read-only
+// archives too.
+func (zf *File) ExtractFileToFs(dst afero.Fs, name string, dir string) error {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return newZipError("ExtractFileToFs", ErrFileNotFound)
+	}
+	dest, err := extractPath(dir, name)
+	if err != nil {
+		return newZipError("ExtractFileToFs", err)
+	}
+	return zf.extractSingleFile(context.Background(), &zf.fileHeaders[i], dest, extractHooks{fs: dst})
+}
+
+// ExtractAllToFs is like ExtractAllTo, but it extracts every file into dir on dst
+// instead of the file system that the archive lives on. It works for read-only
+// archives too.
+func (zf *File) ExtractAllToFs(dst afero.Fs, dir string) error {
+	for _, fh := range zf.fileHeaders {
+		dest, err := extractPath(dir, fh.fileName)
+		if err != nil {
+			return newZipError("ExtractAllToFs", err)
+		}
+		err = zf.extractSingleFile(context.Background(), &fh, dest, extractHooks{fs: dst})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractAllWithOptions is like ExtractAllTo, but it extracts files as opts says. For
+// archives that can't be trusted, it checks the limits in opts as each file is
+// extracted. The limits are enforced on the data as it's decompressed, since the sizes
+// in the archive could be lies. It stops with ErrTooLarge at the first file that goes
+// over a limit, without leaving that file behind.
+func (zf *File) ExtractAllWithOptions(dir string, opts ExtractOptions) error {
+	var extracted int64
+	for _, fh := range zf.fileHeaders {
+		dest, err := extractPath(dir, fh.fileName)
+		if err != nil {
+			return newZipError("ExtractAllWithOptions", err)
+		}
+		maxRatioErr := fmt.Errorf("%w: %s decompresses to more than %d times its compressed size", ErrTooLarge, fh.fileName, opts.MaxRatio)
+		if opts.MaxRatio > 0 && int64(fh.uncompressedSize) > ratioLimit(fh.compressedSize, opts.MaxRatio) {
+			return newZipError("ExtractAllWithOptions", maxRatioErr)
+		}
+		maxTotalErr := fmt.Errorf("%w: extracting %s goes over %d bytes in all", ErrTooLarge, fh.fileName, opts.MaxTotalBytes)
+		if opts.MaxTotalBytes > 0 && int64(fh.uncompressedSize) > opts.MaxTotalBytes-extracted {
+			return newZipError("ExtractAllWithOptions", maxTotalErr)
+		}
+
+		wrap := func(r io.Reader) io.Reader {
+			if opts.MaxRatio > 0 {
+				r = &limitReader{r: r, n: ratioLimit(fh.compressedSize, opts.MaxRatio), err: maxRatioErr}
+			}
+			if opts.MaxTotalBytes > 0 {
+				r = &limitReader{r: r, n: opts.MaxTotalBytes - extracted, err: maxTotalErr}
+			}
+			return r
+		}
+		err = zf.extractSingleFile(context.Background(), &fh, dest, extractHooks{wrap: wrap, progress: func(n int64) {
+			extracted += n
+		}, noVerify: opts.NoVerify})
+		if err != nil {
+			return newZipError("ExtractAllWithOptions", err)
+		}
+	}
+	return nil
+}
+
+// ExtractAllContext is like ExtractAll, but it stops with ctx's error if ctx is done.
+// The file being extracted when ctx is done isn't left behind.
+func (zf *File) ExtractAllContext(ctx context.Context) error {
+	for _, fh := range zf.fileHeaders {
+		err := zf.extractHere(ctx, &fh, extractHooks{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractAllContinue is like ExtractAll, but it doesn't stop at a file that fails: it
+// tries to extract every file, and returns the errors for all of the files that failed
+// joined together.
+func (zf *File) ExtractAllContinue() error {
+	errs := []error{}
+	for _, fh := range zf.fileHeaders {
+		err := zf.extractHere(context.Background(), &fh, extractHooks{})
+		if err != nil {
+			errs = append(errs, newZipError("Extract "+fh.fileName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ExtractAllWithProgress is like ExtractAll, but it calls fn as each file starts and as
+// its data is written. fn is given the file's name, the number of bytes extracted so
+// far from the whole archive, and the total uncompressed size of the archive.
+func (zf *File) ExtractAllWithProgress(fn func(name string, bytesDone int64, bytesTotal int64)) error {
+	var bytesTotal int64
+	for _, fh := range zf.fileHeaders {
+		bytesTotal += int64(fh.uncompressedSize)
+	}
+
+	var bytesDone int64
+	for _, fh := range zf.fileHeaders {
+		fn(fh.fileName, bytesDone, bytesTotal)
+		err := zf.extractHere(context.Background(), &fh, extractHooks{progress: func(n int64) {
+			bytesDone += n
+			fn(fh.fileName, bytesDone, bytesTotal)
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractHere extracts the file with the given header into the current working
+// directory. Like ExtractAllTo, it refuses a file whose name would put it outside the
+// directory.
+func (zf *File) extractHere(ctx context.Context, fh *fileHeader, hooks extractHooks) error {
+	dest, err := extractPath(".", fh.fileName)
+	if err != nil {
+		return newZipError("Extract", err)
+	}
+	return zf.extractSingleFile(ctx, fh, dest, hooks)
+}
+
+// extractHooks are the optional parts of extracting a file.
+type extractHooks struct {
+	wrap     func(r io.Reader) io.Reader // if not nil, wraps the decompressed data, to check limits
+	progress func(n int64)               // if not nil, called with the number of bytes as they're written
+	noVerify bool                        // whether to skip checking the CRC
+	fs       afero.Fs                    // if not nil, where to extract to instead of zf.fs
+}
+
+// extractSingleFile extracts the file with the given header to the path dest.
+func (zf *File) extractSingleFile(ctx context.Context, fh *fileHeader, dest string, hooks extractHooks) error {
+	dst := hooks.fs
+	if dst == nil {
+		err := zf.checkWritable("Extract")
+		if err != nil {
+			return err
+		}
+		dst = zf.fs
+	}
+	err := ctx.Err()
 	if err != nil {
 		return err
 	}
 
-	// seek past file name and extra field to get to file data
-	offsetFromCurrent := fh.nameLength + extraFieldLength
-	_, err = zf.file.Seek(int64(offsetFromCurrent), io.SeekCurrent)
+	// Directory entries have no data; just make the directory
+	if strings.HasSuffix(fh.fileName, "/") {
+		return dst.MkdirAll(dest, 0755)
+	}
+
+	rc, err := zf.openFileData(fh)
 	if err != nil {
 		return err
 	}
+	defer rc.Close()
+	var fileData io.Reader = rc
+	if hooks.wrap != nil {
+		fileData = hooks.wrap(fileData)
+	}
+	if dir := filepath.Dir(dest); dir != "." {
+		err = dst.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	if fh.isSymlink() {
+		return zf.extractSymlink(dst, fh, fileData, dest, !hooks.noVerify)
+	}
 
-	// file pointer is now at the start of the file data. Read fh.compressedSize bytes from
-	// zf.file and write them to outfile.
-	outfileTempName := tempName(fh.fileName)
-	outfile, err := zf.fs.Create(outfileTempName)
+	// Read fh.compressedSize bytes from zf.file and write them to outfile, computing the
+	// CRC as we go.
+	outfile, outfileTempName, err := createTempFile(dst, dest)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(outfile, io.LimitReader(zf.file, int64(fh.compressedSize)))
+	hash := crc32.NewIEEE()
+	var w io.Writer = outfile
+	if hooks.progress != nil {
+		w = &progressWriter{w: outfile, progress: hooks.progress}
+	}
+	_, err = io.Copy(w, io.TeeReader(&contextReader{ctx: ctx, r: fileData}, hash))
 	if err != nil {
-		zf.closeAndDeleteTempFile(outfile, outfileTempName)
+		closeAndDeleteTempFile(dst, outfile, outfileTempName)
 		return err
 	}
 
 	// Check the CRC
-	crcValid, err := checkCrc(fh.crc, outfile)
+	if !hooks.noVerify && !fh.crcMatches(hash.Sum32()) {
+		closeAndDeleteTempFile(dst, outfile, outfileTempName)
+		return errors.New("CRC mismatch")
+	}
+
+	// Close outfile and rename it from its temporary name to the original file name
+	err = closeAndRenameTempFile(dst, outfile, outfileTempName, dest)
+	if err != nil {
+		return err
+	}
+
+	// End by restoring the file's permissions and modification time
+	err = dst.Chmod(dest, fh.permissions())
+	if err != nil {
+		return err
+	}
+	modTime := fh.getDateTime(zf.timeLocation())
+	err = dst.Chtimes(dest, modTime, modTime)
+	if err != nil {
+		return err
+	}
+	if zf.restoreOwner {
+		uid, gid, ok := fh.owner()
+		if ok {
+			return dst.Chown(dest, uid, gid)
+		}
+	}
+	return nil
+}
+
+// extractSymlink makes a symlink at dest on dst for the symlink entry with the given
+// header, whose data is the link's target, checking its CRC if verify is true. Targets
+// that would point outside the directory the archive is extracted into are refused, so
+// that later files can't be written through the link.
+func (zf *File) extractSymlink(dst afero.Fs, fh *fileHeader, fileData io.Reader, dest string, verify bool) error {
+	linker, ok := dst.(afero.Symlinker)
+	if !ok {
+		return fmt.Errorf("can't extract symlink %s: %w", fh.fileName, afero.ErrNoSymlink)
+	}
+	target, err := io.ReadAll(fileData)
+	if err != nil {
+		return err
+	}
+	if verify && !fh.crcMatches(crc32.ChecksumIEEE(target)) {
+		return errors.New("CRC mismatch")
+	}
+	err = checkSymlinkTarget(fh, string(target))
+	if err != nil {
+		return err
+	}
+
+	// Like extracting a file, replace anything that's already there
+	err = dst.Remove(dest)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return linker.SymlinkIfPossible(string(target), dest)
+}
+
+// checkSymlinkTarget returns ErrInsecurePath if the symlink entry with the given header
+// points to target outside the directory that the archive is extracted into.
+func checkSymlinkTarget(fh *fileHeader, target string) error {
+	linkPath := path.Join(path.Dir(fh.fileName), filepath.ToSlash(target))
+	if filepath.IsAbs(target) || !filepath.IsLocal(filepath.FromSlash(linkPath)) {
+		return fmt.Errorf("%w: symlink %s points to %q", ErrInsecurePath, fh.fileName, target)
+	}
+	return nil
+}
+
+// ExtractAllDryRun does everything that ExtractAll would, without writing anything:
+// each file is decompressed and its CRC is checked, and its name is checked for
+// whether it's safe to extract and whether its directories can be made (they can't
+// if a file in the archive or on disk is in the way). It returns the errors for all
+// of the files that would fail joined together, like ExtractAllContinue.
+func (zf *File) ExtractAllDryRun() error {
+	files := map[string]bool{} // names of the files in the archive that aren't directories
+	for _, fh := range zf.fileHeaders {
+		if !strings.HasSuffix(fh.fileName, "/") {
+			files[fh.fileName] = true
+		}
+	}
+	errs := []error{}
+	for i := range zf.fileHeaders {
+		fh := &zf.fileHeaders[i]
+		err := zf.dryRunSingleFile(fh, files)
+		if err != nil {
+			errs = append(errs, newZipError("Extract "+fh.fileName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dryRunSingleFile checks whether the file with the given header could be extracted,
+// for ExtractAllDryRun. files has the names of the archive's files that aren't
+// directories.
+func (zf *File) dryRunSingleFile(fh *fileHeader, files map[string]bool) error {
+	_, err := extractPath(".", fh.fileName)
+	if err != nil {
+		return err
+	}
+	for dir := path.Dir(strings.TrimSuffix(fh.fileName, "/")); dir != "."; dir = path.Dir(dir) {
+		if files[dir] {
+			return fmt.Errorf("can't make directory %s, since the archive has a file with that name", dir)
+		}
+		if zf.fs != nil {
+			info, err := zf.fs.Stat(filepath.FromSlash(dir))
+			if err == nil && !info.IsDir() {
+				return fmt.Errorf("can't make directory %s, since there's a file with that name", dir)
+			}
+		}
+	}
+	if strings.HasSuffix(fh.fileName, "/") {
+		return nil
+	}
+
+	fileData, err := zf.openFileData(fh)
+	if err != nil {
+		return err
+	}
+	defer fileData.Close()
+	if fh.isSymlink() {
+		target, err := io.ReadAll(fileData)
+		if err != nil {
+			return err
+		}
+		if !fh.crcMatches(crc32.ChecksumIEEE(target)) {
+			return errors.New("CRC mismatch")
+		}
+		return checkSymlinkTarget(fh, string(target))
+	}
+	hash := crc32.NewIEEE()
+	_, err = io.Copy(hash, fileData)
 	if err != nil {
-		zf.closeAndDeleteTempFile(outfile, outfileTempName)
 		return err
 	}
-	if !crcValid {
-		zf.closeAndDeleteTempFile(outfile, outfileTempName)
+	if !fh.crcMatches(hash.Sum32()) {
 		return errors.New("CRC mismatch")
 	}
+	return nil
+}
+
+// openFileData returns a reader for the data of the file with the given header, which
+// must be closed to release its decompressor. The CRC and sizes always come from the
+// central directory. If the file has a data descriptor (FLAG_DATA_DESCRIPTOR), they're
+// zero in its local header, so the local header is only used to find where the data
+// starts.
+func (zf *File) openFileData(fh *fileHeader) (io.ReadCloser, error) {
+	method := CompressionMethod(fh.compressionMethod)
+	extra, isAES := fh.aesExtra()
+	if fh.flags&FLAG_ENCRYPTED != 0 && (!isAES || method != COMPRESS_AES || zf.password == "") {
+		return nil, fmt.Errorf("%w: %q", ErrEncrypted, fh.fileName)
+	}
+	fileData, err := zf.rawFileData(fh)
+	if err != nil {
+		return nil, err
+	}
+	if fh.flags&FLAG_ENCRYPTED != 0 {
+		fileData, err = newAESReader(fh, extra, fileData, zf.password)
+		if err != nil {
+			return nil, err
+		}
+		method = CompressionMethod(extra.method)
+	}
+	switch method {
+	case COMPRESS_STORED:
+		return io.NopCloser(fileData), nil
+	case COMPRESS_DEFLATED:
+		return flate.NewReader(fileData), nil
+	case COMPRESS_BZIP2:
+		return io.NopCloser(bzip2.NewReader(fileData)), nil
+	case COMPRESS_ZSTD:
+		decoder, err := zstd.NewReader(fileData, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, unsupportedMethodError(fh, method)
+	}
+}
+
+// VerifyFile checks the CRC of the named file in the archive without extracting it.
+func (zf *File) VerifyFile(name string) error {
+	i := zf.findFileHeader(name)
+	if i < 0 {
+		return newZipError("VerifyFile", ErrFileNotFound)
+	}
+	return zf.verifySingleFile(context.Background(), "VerifyFile", &zf.fileHeaders[i])
+}
+
+// VerifyAll checks the CRC of every file in the archive without extracting anything.
+// It returns an error for the first file that fails.
+func (zf *File) VerifyAll() error {
+	return zf.VerifyAllContext(context.Background())
+}
+
+// VerifyAllContext is like VerifyAll, but it stops with ctx's error if ctx is done.
+func (zf *File) VerifyAllContext(ctx context.Context) error {
+	for i := range zf.fileHeaders {
+		err := zf.verifySingleFile(ctx, "VerifyAll", &zf.fileHeaders[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyEach checks the CRC of every file in the archive like VerifyAll, but it doesn't
+// stop at a file that fails: it calls fn for each entry, in the archive's order, with
+// the error from checking it (or nil). Entries with the same name are each checked.
+func (zf *File) VerifyEach(fn func(e Entry, err error)) {
+	for i := range zf.fileHeaders {
+		fh := &zf.fileHeaders[i]
+		fn(fh.entry(zf.timeLocation()), zf.verifySingleFile(context.Background(), "VerifyEach", fh))
+	}
+}
+
+func (zf *File) verifySingleFile(ctx context.Context, operation string, fh *fileHeader) error {
+	crc, err := zf.fileCrc(ctx, fh)
+	if err != nil {
+		return newZipError(operation, err)
+	}
+	if !fh.crcMatches(crc) {
+		return newZipErrorStr(operation, fmt.Sprintf("CRC mismatch in %s", fh.fileName))
+	}
+	return nil
+}
 
-	// End by closing outfile and renaming it from its temporary name to the original file name
-	return zf.closeAndRenameTempFile(outfile, outfileTempName, fh.fileName)
+// fileCrc reads the data of the file with the given header and returns its CRC.
+func (zf *File) fileCrc(ctx context.Context, fh *fileHeader) (uint32, error) {
+	fileData, err := zf.openFileData(fh)
+	if err != nil {
+		return 0, err
+	}
+	defer fileData.Close()
+	hash := crc32.NewIEEE()
+	_, err = io.Copy(hash, &contextReader{ctx: ctx, r: fileData})
+	if err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
 }
@@ -3,10 +3,25 @@ package zip
 import (
 	"archive/zip"
 	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/afero"
 )
 
@@ -26,6 +41,15 @@ func makeTestFile(fs afero.Fs, name string, data []byte) error {
 	return nil
 }
 
+// tempFiles returns the names of any temp files for name that are left behind.
+func tempFiles(t *testing.T, fs afero.Fs, name string) []string {
+	matches, err := afero.Glob(fs, name+".*.tmp")
+	if err != nil {
+		t.Fatalf("afero.Glob returned error: %v", err)
+	}
+	return matches
+}
+
 type testfile struct {
 	name    string
 	comment string
@@ -33,6 +57,11 @@ type testfile struct {
 }
 
 func makeZipFile(t *testing.T, fs afero.Fs, zipname string, comment string, files []testfile) {
+	makeZipFileWithMethod(t, fs, zipname, comment, files, zip.Store)
+}
+
+// makeZipFileWithMethod is like makeZipFile, but the files are compressed with method.
+func makeZipFileWithMethod(t *testing.T, fs afero.Fs, zipname string, comment string, files []testfile, method uint16) {
 	// Create test zip file using a different zip writer (so this test doesn't depend
 	// on my implementation of adding files to zip archive)
 	zipFile, err := fs.Create(zipname)
@@ -49,7 +78,7 @@ func makeZipFile(t *testing.T, fs afero.Fs, zipname string, comment string, file
 			Name:           f.name,
 			Comment:        f.comment,
 			Modified:       time.Now(),
-			Method:         zip.Store,
+			Method:         method,
 			CreatorVersion: 0x20,
 			ReaderVersion:  0x20,
 		}
@@ -65,6 +94,36 @@ func makeZipFile(t *testing.T, fs afero.Fs, zipname string, comment string, file
 	zipWriter.SetComment(comment)
 }
 
+// Creates a zip file with one entry whose data is already compressed with the given
+// method, for methods that the other zip writer can't compress
+func makeCompressedZipFile(t *testing.T, fs afero.Fs, zipname string, name string, method uint16, data []byte, compressed []byte) {
+	zipFile, err := fs.Create(zipname)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	defer zipFile.Close()
+
+	zipWriter := zip.NewWriter(zipFile)
+	defer zipWriter.Close()
+
+	header := zip.FileHeader{
+		Name:               name,
+		Modified:           time.Now(),
+		Method:             method,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(len(compressed)),
+		UncompressedSize64: uint64(len(data)),
+	}
+	writer, err := zipWriter.CreateRaw(&header)
+	if err != nil {
+		t.Fatalf("zipWriter.CreateRaw returned error: %v", err)
+	}
+	_, err = writer.Write(compressed)
+	if err != nil {
+		t.Fatalf("writer.Write returned error: %v", err)
+	}
+}
+
 // Confirms that a zip file contains the expected files
 func verifyZipFile(t *testing.T, fs afero.Fs, zipname string, expZipComment string, expFiles []testfile) error {
 	zipFile, err := fs.Open(zipname)
@@ -100,16 +159,15 @@ func verifyZipFile(t *testing.T, fs afero.Fs, zipname string, expZipComment stri
 		if err != nil {
 			return err
 		}
-		fData := make([]byte, len(expFiles[i].data))
-		fDataSize, err := fFile.Read(fData)
+		fData, err := io.ReadAll(fFile)
 		if err != nil {
 			fFile.Close()
 			return err
 		}
-		if fDataSize != len(expFiles[i].data) {
-			t.Errorf("zipReader.File[%d].Data has length %d; Want: %d", i, fDataSize, len(expFiles[i].data))
+		if len(fData) != len(expFiles[i].data) {
+			t.Errorf("zipReader.File[%d].Data has length %d; Want: %d", i, len(fData), len(expFiles[i].data))
 		}
-		if !reflect.DeepEqual(fData, expFiles[i].data) {
+		if !bytes.Equal(fData, expFiles[i].data) {
 			t.Errorf("zipReader.File[%d].Data is %x; Want: %x", i, fData, expFiles[i].data)
 		}
 		fFile.Close()
@@ -117,6 +175,24 @@ func verifyZipFile(t *testing.T, fs afero.Fs, zipname string, expZipComment stri
 	return nil
 }
 
+// verifyReadBack reopens the archive with this package and checks that every file in
+// expFiles reads back with the expected data.
+func verifyReadBack(t *testing.T, fs afero.Fs, zipname string, expFiles []testfile) {
+	zf, err := OpenWithFs(zipname, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	for _, f := range expFiles {
+		data, err := zf.ReadFile(f.name)
+		if err != nil {
+			t.Errorf("ReadFile(%s) returned error: %v", f.name, err)
+		} else if !bytes.Equal(data, f.data) {
+			t.Errorf("ReadFile(%s) returned %q; Want: %q", f.name, data, f.data)
+		}
+	}
+}
+
 // Confirms that a file contains the expected data
 func verifyFile(t *testing.T, fs afero.Fs, name string, data []byte) error {
 	file, err := fs.Open(name)
@@ -379,6 +455,40 @@ func TestDelete(t *testing.T) {
 	verifyZipFile(t, fs, zipFileName, "", files[1:])
 }
 
+func TestDeleteMissing(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.RemoveFile("missing.txt")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("RemoveFile returned %v; Want: %v", err, ErrFileNotFound)
+	}
+	err = zf.RemoveFileIfExists("missing.txt")
+	if err != nil {
+		t.Errorf("RemoveFileIfExists returned error: %v", err)
+	}
+	err = zf.RemoveFileIfExists(files[0].name)
+	if err != nil {
+		t.Fatalf("RemoveFileIfExists returned error: %v", err)
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	verifyZipFile(t, fs, zipFileName, "", files[1:])
+}
+
 func TestAdd(t *testing.T) {
 	fs := afero.NewMemMapFs()
 	zipFileName := "testArchive.zip"
@@ -410,3 +520,4199 @@ func TestAdd(t *testing.T) {
 	files = append(files, fileToAdd)
 	verifyZipFile(t, fs, zipFileName, "", files)
 }
+
+func TestSave(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "first comment", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+
+	makeZipFile(t, fs, zipFileName, "archive comment", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.Save()
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	verifyZipFile(t, fs, zipFileName, "archive comment", files)
+}
+
+func TestFileComment(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "first comment", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+
+	comment, err := zf.FileComment(files[0].name)
+	if err != nil {
+		t.Errorf("FileComment returned error: %v", err)
+	}
+	if comment != files[0].comment {
+		t.Errorf("FileComment returned %q; Want: %q", comment, files[0].comment)
+	}
+	_, err = zf.FileComment("missing.txt")
+	if err == nil {
+		t.Errorf("FileComment should have failed for a missing file, but didn't")
+	}
+	err = zf.SetFileComment("missing.txt", "comment")
+	if err == nil {
+		t.Errorf("SetFileComment should have failed for a missing file, but didn't")
+	}
+	err = zf.SetFileComment(files[1].name, string(make([]byte, 65536)))
+	if err == nil {
+		t.Errorf("SetFileComment should have failed for a comment that's too long, but didn't")
+	}
+
+	files[0].comment = ""
+	files[1].comment = "provenance: test"
+	for _, f := range files {
+		err = zf.SetFileComment(f.name, f.comment)
+		if err != nil {
+			t.Fatalf("SetFileComment returned error: %v", err)
+		}
+	}
+	err = zf.Save()
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestAddDir(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	err := fs.MkdirAll("tree/empty", 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll returned error: %v", err)
+	}
+	makeTestFile(fs, "tree/a.txt", []byte("File a"))
+	makeTestFile(fs, "tree/sub/b.txt", []byte("File b, in a subdirectory"))
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.AddDir("tree", COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddDir returned error: %v", err)
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	files = append(files,
+		testfile{"a.txt", "", []byte("File a")},
+		testfile{"empty/", "", []byte{}},
+		testfile{"sub/", "", []byte{}},
+		testfile{"sub/b.txt", "", []byte("File b, in a subdirectory")},
+	)
+	err = verifyZipFile(t, fs, zipFileName, "", files)
+	if err != nil {
+		t.Errorf("verifyZipFile returned error: %v", err)
+	}
+}
+
+func TestAddDirEmptyDirectory(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	err := fs.MkdirAll("tree/logs", 0750)
+	if err != nil {
+		t.Fatalf("MkdirAll returned error: %v", err)
+	}
+	makeTestFile(fs, "tree/a.txt", []byte("File a"))
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.AddDir("tree", COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddDir returned error: %v", err)
+	}
+	i := zf.findFileHeader("logs/")
+	if i < 0 {
+		t.Fatalf("Names returned %v; Want it to have logs/", zf.Names())
+	}
+	fh := zf.fileHeaders[i]
+	if fh.externalAttr&EXTERNAL_ATTR_DIR == 0 || fh.externalAttr>>16 != S_IFDIR|0750 {
+		t.Errorf("logs/ has external attributes %#x; Want the directory attribute and mode %o", fh.externalAttr, S_IFDIR|0750)
+	}
+	if fh.fileMode() != os.ModeDir|0750 {
+		t.Errorf("logs/ has mode %v; Want: %v", fh.fileMode(), os.ModeDir|0750)
+	}
+
+	err = zf.ExtractAllTo("elsewhere")
+	if err != nil {
+		t.Fatalf("ExtractAllTo returned error: %v", err)
+	}
+	info, err := fs.Stat(filepath.Join("elsewhere", "logs"))
+	if err != nil {
+		t.Fatalf("fs.Stat returned error: %v", err)
+	}
+	if !info.IsDir() {
+		t.Error("Extracting logs/ didn't make a directory")
+	}
+}
+
+func TestAddUnsupportedMethod(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	makeTestFile(fs, "fileTwo.txt", []byte("File number 2"))
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.AddFile("fileTwo.txt", 93)
+	var zipErr *ZipError
+	if !errors.As(err, &zipErr) {
+		t.Errorf("AddFile returned error %v; Want: a *ZipError", err)
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	// The archive is untouched
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestZip64(t *testing.T) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	header := zip.FileHeader{
+		Name:               "file1.txt",
+		Method:             zip.Store,
+		Extra:              []byte("\x01\x00\x10\x00\x04\x00\x00\x00\x00\x00\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00"),
+		CRC32:              crc32.ChecksumIEEE([]byte("data")),
+		CompressedSize64:   4,
+		UncompressedSize64: 4,
+	}
+	writer, err := zipWriter.CreateRaw(&header)
+	if err != nil {
+		t.Fatalf("zipWriter.CreateRaw returned error: %v", err)
+	}
+	writer.Write([]byte("data"))
+	zipWriter.Close()
+	archive := buf.Bytes()
+	eocd := bytes.LastIndex(archive, []byte("PK\x05\x06"))
+	centralDir := bytes.LastIndex(archive, []byte("PK\x01\x02"))
+
+	var testcases = []struct {
+		name   string
+		offset int // where to write all ones
+		size   int
+	}{
+		{"number of entries", eocd + 10, 2},
+		{"central directory offset", eocd + 16, 4},
+		{"entry's compressed size", centralDir + 20, 4},
+	}
+	for _, c := range testcases {
+		data := bytes.Clone(archive)
+		for i := 0; i < c.size; i++ {
+			data[c.offset+i] = 0xff
+		}
+		_, err = OpenBytes(data)
+		if !errors.Is(err, ErrZip64) {
+			t.Errorf("OpenBytes with all ones in the %s returned %v; Want: %v", c.name, err, ErrZip64)
+		}
+	}
+
+	// Without the sentinels, the archive is fine
+	_, err = OpenBytes(archive)
+	if err != nil {
+		t.Errorf("OpenBytes returned error: %v", err)
+	}
+}
+
+func TestMultiDisk(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	makeZipFile(t, fs, zipFileName, "", []testfile{{"file1.txt", "", []byte("This archive contains some text files.")}})
+	archive, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	eocd := bytes.LastIndex(archive, []byte("PK\x05\x06"))
+	centralDir := bytes.LastIndex(archive, []byte("PK\x01\x02"))
+
+	var testcases = []struct {
+		name   string
+		offset int // where to write a disk number
+	}{
+		{"number of this disk", eocd + 4},
+		{"disk with the central directory", eocd + 6},
+		{"entry's starting disk", centralDir + 34},
+	}
+	for _, c := range testcases {
+		data := bytes.Clone(archive)
+		data[c.offset] = 1
+		_, err = OpenBytes(data)
+		if !errors.Is(err, ErrMultiDisk) {
+			t.Errorf("OpenBytes with a nonzero %s returned %v; Want: %v", c.name, err, ErrMultiDisk)
+		}
+	}
+}
+
+func TestEntryPastEndOfArchive(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+
+	// Make the central directory say that the file's data is 1 MB
+	centralDir := bytes.LastIndex(data, []byte("PK\x01\x02"))
+	binary.LittleEndian.PutUint32(data[centralDir+20:], 1<<20)
+	err = afero.WriteFile(fs, zipFileName, data, 0644)
+	if err != nil {
+		t.Fatalf("afero.WriteFile returned error: %v", err)
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	_, err = zf.ReadFile("file1.txt")
+	if err == nil || !strings.Contains(err.Error(), "extends past end of archive") {
+		t.Errorf("ReadFile returned %v; Want an error about the data extending past the end of the archive", err)
+	}
+	err = zf.ExtractFile("file1.txt")
+	if err == nil || !strings.Contains(err.Error(), "extends past end of archive") {
+		t.Errorf("ExtractFile returned %v; Want an error about the data extending past the end of the archive", err)
+	}
+}
+
+func TestReadDirectoryLongComment(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+
+	// The comment contains something that looks like an end-of-central-directory
+	// record (5 entries, a 16 byte directory at offset 0, a 256 byte comment), but
+	// its comment length doesn't reach the end of the file.
+	comment := string(bytes.Repeat([]byte("A long archive comment. "), 100)) +
+		"\x50\x4b\x05\x06\x00\x00\x00\x00\x05\x00\x05\x00\x10\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+		"More comment after the fake record."
+	makeZipFile(t, fs, zipFileName, comment, files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	if zf.numEntries != 1 {
+		t.Errorf("zf.numEntries = %d; want %d", zf.numEntries, 1)
+	}
+	if string(zf.comment) != comment {
+		t.Errorf("zf.comment = %q; want %q", zf.comment, comment)
+	}
+	if len(zf.fileHeaders) != 1 || zf.fileHeaders[0].fileName != files[0].name {
+		t.Errorf("zf.fileHeaders = %v; want a single header for %q", zf.fileHeaders, files[0].name)
+	}
+}
+
+func TestList(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "first comment", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	entries := zf.List()
+	if len(entries) != len(files) {
+		t.Fatalf("List returned %d entries; Want: %d", len(entries), len(files))
+	}
+	for i, e := range entries {
+		if e.Name != files[i].name {
+			t.Errorf("entries[%d].Name is %q; Want: %q", i, e.Name, files[i].name)
+		}
+		if e.Comment != files[i].comment {
+			t.Errorf("entries[%d].Comment is %q; Want: %q", i, e.Comment, files[i].comment)
+		}
+		if e.UncompressedSize != uint32(len(files[i].data)) {
+			t.Errorf("entries[%d].UncompressedSize is %d; Want: %d", i, e.UncompressedSize, len(files[i].data))
+		}
+	}
+
+	// Changing an entry doesn't change the archive
+	entries[0].Name = "changed.txt"
+	if zf.List()[0].Name != files[0].name {
+		t.Errorf("changing an Entry changed the archive")
+	}
+}
+
+func TestEntryModifiedISO(t *testing.T) {
+	fh := fileHeader{dosTime: 0x4a84, dosDate: 0x597e}
+	want := time.Date(2024, time.November, 30, 9, 20, 8, 0, time.Local).Format(time.RFC3339)
+	if got := fh.entry(time.Local).ModifiedISO(); got != want {
+		t.Errorf("ModifiedISO returned %q; Want: %q", got, want)
+	}
+}
+
+func TestRemoveFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+		{"fileThree.txt", "", []byte("File number 3")},
+	}
+
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	missing, err := zf.RemoveFiles([]string{files[0].name, "missing.txt", files[2].name})
+	if err != nil {
+		t.Fatalf("RemoveFiles returned error: %v", err)
+	}
+	if !reflect.DeepEqual(missing, []string{"missing.txt"}) {
+		t.Errorf("RemoveFiles returned missing names %q; Want: %q", missing, []string{"missing.txt"})
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	verifyZipFile(t, fs, zipFileName, "", files[1:2])
+}
+
+func TestDisplayVerified(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	// Corrupt the second file's data
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	i := bytes.Index(data, files[1].data)
+	data[i] = 'X'
+	err = makeTestFile(fs, zipFileName, data)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	var output bytes.Buffer
+	err = zf.DisplayVerified(&output)
+	if err != nil {
+		t.Errorf("DisplayVerified returned error: %v", err)
+	}
+	for _, line := range strings.Split(output.String(), "\n") {
+		if strings.HasSuffix(line, files[0].name) && !strings.Contains(line, " OK ") {
+			t.Errorf("DisplayVerified line %q should be marked OK", line)
+		}
+		if strings.HasSuffix(line, files[1].name) && !strings.Contains(line, " BAD CRC ") {
+			t.Errorf("DisplayVerified line %q should be marked BAD CRC", line)
+		}
+	}
+}
+
+func TestAddReader(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.AddReader("generated.json", strings.NewReader(`{"generated": true}`), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddReader returned error: %v", err)
+	}
+	// Replaces the existing file
+	err = zf.AddBytes(files[1].name, []byte("Replacement data."), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	// The replacement keeps the original file's place
+	err = verifyZipFile(t, fs, zipFileName, "", []testfile{
+		files[0],
+		{"filebeta.txt", "", []byte("Replacement data.")},
+		{"generated.json", "", []byte(`{"generated": true}`)},
+	})
+	if err != nil {
+		t.Errorf("verifyZipFile returned error: %v", err)
+	}
+}
+
+func TestPreferLastDuplicate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "old", []byte("The original version.")},
+		{"other.txt", "", []byte("Some other file.")},
+		{"file1.txt", "new", []byte("The updated version.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	// By default, the first file wins
+	err = zf.ExtractFile("file1.txt")
+	if err != nil {
+		t.Fatalf("ExtractFile returned error: %v", err)
+	}
+	verifyFile(t, fs, "file1.txt", files[0].data)
+
+	zf.SetPreferLastDuplicate(true)
+	err = zf.ExtractFile("file1.txt")
+	if err != nil {
+		t.Fatalf("ExtractFile returned error: %v", err)
+	}
+	verifyFile(t, fs, "file1.txt", files[2].data)
+
+	comment, err := zf.FileComment("file1.txt")
+	if err != nil {
+		t.Errorf("FileComment returned error: %v", err)
+	}
+	if comment != "new" {
+		t.Errorf("FileComment returned %q; Want: %q", comment, "new")
+	}
+
+	names := []string{}
+	for _, e := range zf.List() {
+		names = append(names, e.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"other.txt", "file1.txt"}) {
+		t.Errorf("List returned names %q; Want: %q", names, []string{"other.txt", "file1.txt"})
+	}
+}
+
+func TestFS(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	makeZipFile(t, fs, zipFileName, "", []testfile{{"file1.txt", "", []byte("Some data.")}})
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	if zf.FS() != fs {
+		t.Errorf("FS returned %v; Want: %v", zf.FS(), fs)
+	}
+	if zf.Name != zipFileName {
+		t.Errorf("zf.Name is %q; Want: %q", zf.Name, zipFileName)
+	}
+}
+
+func TestExtractPermissions(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+
+	// Make an archive with Unix permissions on some files
+	zipFile, err := fs.Create(zipFileName)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	var testcases = []struct {
+		name     string
+		unixMode os.FileMode // 0 for no Unix permissions
+		expMode  os.FileMode
+	}{
+		{"script.sh", 0755, 0755},
+		{"private.txt", 0600, 0600},
+		{"plain.txt", 0, DEFAULT_PERM},
+	}
+	for _, c := range testcases {
+		header := zip.FileHeader{Name: c.name, Method: zip.Store}
+		if c.unixMode != 0 {
+			header.SetMode(c.unixMode)
+		}
+		writer, err := zipWriter.CreateHeader(&header)
+		if err != nil {
+			t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+		}
+		writer.Write([]byte("data for " + c.name))
+	}
+	zipWriter.Close()
+	zipFile.Close()
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.ExtractAll()
+	if err != nil {
+		t.Fatalf("ExtractAll returned error: %v", err)
+	}
+
+	for _, c := range testcases {
+		info, err := fs.Stat(c.name)
+		if err != nil {
+			t.Errorf("fs.Stat returned error: %v", err)
+			continue
+		}
+		if info.Mode().Perm() != c.expMode {
+			t.Errorf("%s has mode %v; Want: %v", c.name, info.Mode().Perm(), c.expMode)
+		}
+	}
+}
+
+func TestVerifyEach(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"file1.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	// Corrupt the second file's data, which has the same name as the first
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	data[bytes.Index(data, files[1].data)] = 'X'
+	err = makeTestFile(fs, zipFileName, data)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	errs := []error{}
+	zf.VerifyEach(func(e Entry, err error) {
+		errs = append(errs, err)
+	})
+	if len(errs) != 2 || errs[0] != nil || errs[1] == nil {
+		t.Errorf("VerifyEach gave errors %v; Want: [<nil> <CRC mismatch>]", errs)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.VerifyAll()
+	if err != nil {
+		t.Errorf("VerifyAll returned error on a valid archive: %v", err)
+	}
+	zf.Close()
+
+	// Corrupt the second file's data
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	i := bytes.Index(data, files[1].data)
+	data[i] = 'X'
+	err = makeTestFile(fs, zipFileName, data)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.VerifyFile(files[0].name)
+	if err != nil {
+		t.Errorf("VerifyFile(%s) returned error: %v", files[0].name, err)
+	}
+	err = zf.VerifyFile(files[1].name)
+	if err == nil {
+		t.Errorf("VerifyFile(%s) should return an error for a bad CRC", files[1].name)
+	}
+	err = zf.VerifyFile("missing.txt")
+	if err == nil {
+		t.Error("VerifyFile should return an error for a missing file")
+	}
+	err = zf.VerifyAll()
+	if err == nil || !strings.Contains(err.Error(), files[1].name) {
+		t.Errorf("VerifyAll returned %v; Want: an error naming %s", err, files[1].name)
+	}
+
+	// Nothing was extracted
+	for _, f := range files {
+		exists, _ := afero.Exists(fs, f.name)
+		if exists {
+			t.Errorf("%s shouldn't exist after verifying", f.name)
+		}
+	}
+}
+
+func TestErrFileNotFound(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	_, fileCommentErr := zf.FileComment("missing.txt")
+	var testcases = []struct {
+		operation string
+		err       error
+	}{
+		{"ExtractFile", zf.ExtractFile("missing.txt")},
+		{"FileComment", fileCommentErr},
+		{"SetFileComment", zf.SetFileComment("missing.txt", "comment")},
+		{"VerifyFile", zf.VerifyFile("missing.txt")},
+		{"RemoveFile", zf.RemoveFile("missing.txt")},
+	}
+	for _, c := range testcases {
+		if !errors.Is(c.err, ErrFileNotFound) {
+			t.Errorf("%s returned %v; Want: %v", c.operation, c.err, ErrFileNotFound)
+		}
+		var zipErr *ZipError
+		if !errors.As(c.err, &zipErr) || zipErr.Operation != c.operation {
+			t.Errorf("%s returned %v; Want: a ZipError for operation %s", c.operation, c.err, c.operation)
+		}
+	}
+}
+
+func TestReadDirectoryNotZip(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	var testcases = []struct {
+		name string
+		data []byte
+	}{
+		{"empty.zip", []byte{}},
+		{"tiny.zip", []byte("PK\x05\x06")},
+		{"large.zip", bytes.Repeat([]byte("not a zip file "), 20000)},
+	}
+	for _, c := range testcases {
+		err := makeTestFile(fs, c.name, c.data)
+		if err != nil {
+			t.Fatalf("makeTestFile returned error: %v", err)
+		}
+		zf, err := OpenWithFs(c.name, fs)
+		if err == nil {
+			zf.Close()
+			t.Errorf("OpenWithFs(%s) should return an error", c.name)
+			continue
+		}
+		var zipErr *ZipError
+		if !errors.As(err, &zipErr) {
+			t.Errorf("OpenWithFs(%s) returned %v; Want: a ZipError", c.name, err)
+		}
+	}
+}
+
+func FuzzReadDirectory(f *testing.F) {
+	// Seed with a couple of valid archives
+	for _, comment := range []string{"", "archive comment"} {
+		var buf bytes.Buffer
+		zipWriter := zip.NewWriter(&buf)
+		for _, name := range []string{"file1.txt", "dir/", "dir/file2.txt"} {
+			writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Comment: "c"})
+			if err != nil {
+				f.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+			}
+			writer.Write([]byte("data for " + name))
+		}
+		zipWriter.SetComment(comment)
+		zipWriter.Close()
+		f.Add(buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := afero.NewMemMapFs()
+		err := makeTestFile(fs, "fuzz.zip", data)
+		if err != nil {
+			t.Fatalf("makeTestFile returned error: %v", err)
+		}
+		zf, err := OpenWithFs("fuzz.zip", fs)
+		if err != nil {
+			return
+		}
+		defer zf.Close()
+		zf.List()
+		zf.VerifyAll()
+		zf.Display(io.Discard)
+	})
+}
+
+func TestReadDirectoryHugeCentralDir(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	// Claim that the central directory is nearly 4 GB
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	binary.LittleEndian.PutUint32(data[len(data)-10:len(data)-6], 0xfffffff0)
+	err = makeTestFile(fs, zipFileName, data)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err == nil {
+		zf.Close()
+		t.Fatal("OpenWithFs should return an error for an oversized central directory")
+	}
+	var zipErr *ZipError
+	if !errors.As(err, &zipErr) {
+		t.Errorf("OpenWithFs returned %v; Want: a ZipError", err)
+	}
+}
+
+func TestExtractBadCrc(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	// Corrupt the file's data
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	i := bytes.Index(data, files[0].data)
+	data[i] = 'X'
+	err = makeTestFile(fs, zipFileName, data)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.ExtractFile(files[0].name)
+	if err == nil {
+		t.Fatal("ExtractFile should return an error for a bad CRC")
+	}
+
+	// Neither the file nor its temp file is left behind
+	exists, _ := afero.Exists(fs, files[0].name)
+	if exists {
+		t.Errorf("%s shouldn't exist after a failed extract", files[0].name)
+	}
+	if temps := tempFiles(t, fs, files[0].name); len(temps) > 0 {
+		t.Errorf("%v shouldn't exist after a failed extract", temps)
+	}
+}
+
+func TestTempFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	err := fs.Chmod(zipFileName, 0640)
+	if err != nil {
+		t.Fatalf("fs.Chmod returned error: %v", err)
+	}
+
+	// Files that look like temp files aren't touched
+	sibling := []byte("Not a temp file.")
+	for _, name := range []string{zipFileName + ".tmp", files[0].name + ".tmp"} {
+		err = makeTestFile(fs, name, sibling)
+		if err != nil {
+			t.Fatalf("makeTestFile returned error: %v", err)
+		}
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.AddBytes("file2.txt", []byte("Second file in the archive."), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+	err = zf.ExtractFile(files[0].name)
+	if err != nil {
+		t.Fatalf("ExtractFile returned error: %v", err)
+	}
+
+	for _, name := range []string{zipFileName + ".tmp", files[0].name + ".tmp"} {
+		data, err := afero.ReadFile(fs, name)
+		if err != nil || !bytes.Equal(data, sibling) {
+			t.Errorf("%s has %q, %v; Want: %q", name, data, err, sibling)
+		}
+	}
+	for _, name := range []string{zipFileName, files[0].name} {
+		if temps := tempFiles(t, fs, name); len(temps) > 0 {
+			t.Errorf("%v shouldn't exist after a successful operation", temps)
+		}
+	}
+
+	// The rewritten archive keeps its permissions
+	info, err := fs.Stat(zipFileName)
+	if err != nil {
+		t.Fatalf("fs.Stat returned error: %v", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("%s has permissions %v; Want: %v", zipFileName, info.Mode().Perm(), os.FileMode(0640))
+	}
+}
+
+// renameFailFs is an afero.Fs whose Rename always fails.
+type renameFailFs struct {
+	afero.Fs
+}
+
+func (renameFailFs) Rename(oldname, newname string) error {
+	return errors.New("rename failed")
+}
+
+func TestAddFileTempName(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{zipFileName + ".tmp", "", []byte("Named like the old temp file.")},
+		{zipFileName + ".123456.tmp", "", []byte("Named like a temp file.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files[:1])
+	for _, f := range files[1:] {
+		err := makeTestFile(fs, f.name, f.data)
+		if err != nil {
+			t.Fatalf("makeTestFile returned error: %v", err)
+		}
+	}
+
+	// Add each file twice, so the second time replaces the first
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		for _, f := range files[1:] {
+			err = zf.AddFile(f.name, COMPRESS_STORED)
+			if err != nil {
+				t.Fatalf("AddFile(%s) returned error: %v", f.name, err)
+			}
+		}
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestRewriteRenameFails(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, renameFailFs{fs})
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.AddBytes("file2.txt", []byte("Second file in the archive."), COMPRESS_STORED)
+	if err == nil {
+		t.Fatal("AddBytes should return an error when the rename fails")
+	}
+
+	// The archive can still be read, and closed
+	data, err := zf.ReadFile(files[0].name)
+	if err != nil || !bytes.Equal(data, files[0].data) {
+		t.Errorf("ReadFile returned %q, %v; Want: %q", data, err, files[0].data)
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Errorf("Close returned error: %v", err)
+	}
+	if temps := tempFiles(t, fs, zipFileName); len(temps) > 0 {
+		t.Errorf("%v shouldn't exist after a failed rename", temps)
+	}
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestNewReader(t *testing.T) {
+	files := []testfile{
+		{"file1.txt", "first", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, f := range files {
+		writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: f.name, Comment: f.comment, Method: zip.Store})
+		if err != nil {
+			t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+		}
+		writer.Write(f.data)
+	}
+	zipWriter.Close()
+
+	zf, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader returned error: %v", err)
+	}
+	defer zf.Close()
+
+	entries := zf.List()
+	if len(entries) != len(files) {
+		t.Fatalf("List returned %d entries; Want: %d", len(entries), len(files))
+	}
+	for i, f := range files {
+		if entries[i].Name != f.name {
+			t.Errorf("List returned %s; Want: %s", entries[i].Name, f.name)
+		}
+	}
+	comment, err := zf.FileComment(files[0].name)
+	if err != nil || comment != files[0].comment {
+		t.Errorf("FileComment returned %q, %v; Want: %q", comment, err, files[0].comment)
+	}
+	err = zf.VerifyAll()
+	if err != nil {
+		t.Errorf("VerifyAll returned error: %v", err)
+	}
+
+	// Anything that writes fails
+	var testcases = []struct {
+		operation string
+		err       error
+	}{
+		{"ExtractAll", zf.ExtractAll()},
+		{"AddBytes", zf.AddBytes("new.txt", []byte("new"), COMPRESS_STORED)},
+		{"AddFile", zf.AddFile("new.txt", COMPRESS_STORED)},
+		{"RemoveFile", zf.RemoveFile(files[0].name)},
+	}
+	for _, c := range testcases {
+		if !errors.Is(c.err, ErrReadOnly) {
+			t.Errorf("%s returned %v; Want: %v", c.operation, c.err, ErrReadOnly)
+		}
+	}
+	if len(zf.List()) != len(files) {
+		t.Errorf("List returned %d entries after failed writes; Want: %d", len(zf.List()), len(files))
+	}
+}
+
+func TestOpenBytes(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+		{"empty.txt", "", []byte{}},
+	}
+	makeZipFile(t, fs, zipFileName, "archive comment", files)
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+
+	zf, err := OpenBytes(data)
+	if err != nil {
+		t.Fatalf("OpenBytes returned error: %v", err)
+	}
+	defer zf.Close()
+	for _, f := range files {
+		fileData, err := zf.ReadFile(f.name)
+		if err != nil {
+			t.Errorf("ReadFile(%s) returned error: %v", f.name, err)
+		} else if !bytes.Equal(fileData, f.data) {
+			t.Errorf("ReadFile(%s) returned %q; Want: %q", f.name, fileData, f.data)
+		}
+	}
+	_, err = zf.ReadFile("missing.txt")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("ReadFile returned %v; Want: %v", err, ErrFileNotFound)
+	}
+
+	var output bytes.Buffer
+	zf.Display(&output)
+	if !strings.Contains(output.String(), "archive comment") || !strings.Contains(output.String(), files[1].name) {
+		t.Errorf("Display output is missing the archive's contents:\n%s", output.String())
+	}
+	err = zf.SetFileComment(files[0].name, "comment")
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SetFileComment returned %v; Want: %v", err, ErrReadOnly)
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"dir/", "", []byte{}},
+		{"dir/filebeta.txt", "", []byte("Second file in the archive.")},
+		{"empty.txt", "", []byte{}},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	contents, err := zf.ReadAll()
+	zf.Close()
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+	if len(contents) != 3 {
+		t.Errorf("ReadAll returned %d files; Want: 3", len(contents))
+	}
+	for _, f := range files {
+		data, ok := contents[f.name]
+		if f.name == "dir/" {
+			if ok {
+				t.Errorf("ReadAll returned the directory %s", f.name)
+			}
+		} else if !ok || !bytes.Equal(data, f.data) {
+			t.Errorf("ReadAll returned %q for %s; Want: %q", data, f.name, f.data)
+		}
+	}
+
+	// Corrupt the last file's data
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	i := bytes.Index(data, files[2].data)
+	data[i] = 'X'
+	err = makeTestFile(fs, zipFileName, data)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	_, err = zf.ReadAll()
+	if err == nil || !strings.Contains(err.Error(), files[2].name) {
+		t.Errorf("ReadAll returned %v; Want: an error naming %s", err, files[2].name)
+	}
+}
+
+func TestWriteStream(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "first", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "archive comment", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	// A pipe can't seek
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(zf.WriteStream(pw))
+	}()
+	data, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("WriteStream returned error: %v", err)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	if zipReader.Comment != "archive comment" {
+		t.Errorf("Archive has comment %q; Want: %q", zipReader.Comment, "archive comment")
+	}
+	for i, f := range files {
+		zipFile := zipReader.File[i]
+		if zipFile.Name != f.name || zipFile.Comment != f.comment {
+			t.Errorf("File %d is %s (%q); Want: %s (%q)", i, zipFile.Name, zipFile.Comment, f.name, f.comment)
+		}
+		if zipFile.Flags&FLAG_DATA_DESCRIPTOR == 0 {
+			t.Errorf("%s doesn't have the data descriptor flag", f.name)
+		}
+		rc, err := zipFile.Open()
+		if err != nil {
+			t.Fatalf("Open returned error: %v", err)
+		}
+		fileData, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("io.ReadAll(%s) returned error: %v", f.name, err)
+		} else if !bytes.Equal(fileData, f.data) {
+			t.Errorf("%s has data %q; Want: %q", f.name, fileData, f.data)
+		}
+	}
+
+	// The archive on disk is unchanged
+	verifyZipFile(t, fs, zipFileName, "archive comment", files)
+}
+
+func TestWriteTo(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "first", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "archive comment", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.SetFileComment("filebeta.txt", "second")
+	if err != nil {
+		t.Fatalf("SetFileComment returned error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	n, err := zf.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo returned error: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d; Want: %d", n, buf.Len())
+	}
+
+	// WriteTo writes the same archive as Save
+	err = zf.Save()
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	saved, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), saved) {
+		t.Error("WriteTo wrote a different archive than Save")
+	}
+}
+
+func TestClone(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "first", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "archive comment", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	clone, err := zf.Clone("clone.zip")
+	if err != nil {
+		t.Fatalf("Clone returned error: %v", err)
+	}
+	defer clone.Close()
+
+	original, _ := afero.ReadFile(fs, zipFileName)
+	copied, _ := afero.ReadFile(fs, "clone.zip")
+	if !bytes.Equal(original, copied) {
+		t.Error("Clone didn't make an identical copy")
+	}
+
+	// Changing the clone doesn't change the original
+	err = clone.RemoveFile("file1.txt")
+	if err != nil {
+		t.Fatalf("RemoveFile returned error: %v", err)
+	}
+	verifyZipFile(t, fs, "clone.zip", "archive comment", files[1:])
+	verifyZipFile(t, fs, zipFileName, "archive comment", files)
+	if !zf.Contains("file1.txt") {
+		t.Error("Removing a file from the clone removed it from the original")
+	}
+}
+
+func TestExtractDataDescriptor(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+
+	// Stream the archive so every file has a data descriptor
+	var buf bytes.Buffer
+	zw := NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.CreateEntry(f.name, COMPRESS_STORED)
+		if err != nil {
+			t.Fatalf("CreateEntry returned error: %v", err)
+		}
+		w.Write(f.data)
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	data := buf.Bytes()
+
+	// The local headers have the flag set and zero CRC and sizes
+	localHeader := data[:30]
+	if binary.LittleEndian.Uint16(localHeader[6:8])&FLAG_DATA_DESCRIPTOR == 0 {
+		t.Fatal("Local header doesn't have the data descriptor flag")
+	}
+	if !bytes.Equal(localHeader[14:26], make([]byte, 12)) {
+		t.Fatalf("Local header has CRC and sizes %x; Want: zeros", localHeader[14:26])
+	}
+
+	err = makeTestFile(fs, zipFileName, data)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.ExtractAll()
+	if err != nil {
+		t.Fatalf("ExtractAll returned error: %v", err)
+	}
+	for _, f := range files {
+		fileData, err := afero.ReadFile(fs, f.name)
+		if err != nil {
+			t.Errorf("afero.ReadFile returned error: %v", err)
+		} else if !bytes.Equal(fileData, f.data) {
+			t.Errorf("%s has data %q; Want: %q", f.name, fileData, f.data)
+		}
+	}
+}
+
+func TestSelfExtractingPrefix(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	// Put a stub in front of the zip data
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	stub := bytes.Repeat([]byte("#!stub\n"), 50)
+	err = makeTestFile(fs, zipFileName, append(slices.Clone(stub), data...))
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.ExtractAll()
+	if err != nil {
+		t.Fatalf("ExtractAll returned error: %v", err)
+	}
+	for _, f := range files {
+		fileData, err := afero.ReadFile(fs, f.name)
+		if err != nil {
+			t.Errorf("afero.ReadFile returned error: %v", err)
+		} else if !bytes.Equal(fileData, f.data) {
+			t.Errorf("%s has data %q; Want: %q", f.name, fileData, f.data)
+		}
+	}
+
+	// Rewriting the archive keeps the stub
+	newFile := testfile{"fileThree.txt", "", []byte("File number 3")}
+	err = zf.AddBytes(newFile.name, newFile.data, COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+	zf.Close()
+	data, err = afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	if !bytes.HasPrefix(data, stub) {
+		t.Error("Rewritten archive doesn't start with the stub")
+	}
+	verifyZipFile(t, fs, zipFileName, "", append(files, newFile))
+
+	// The rewritten archive's offsets count the stub (like "zip -A" makes them), and
+	// rewriting it again still keeps the stub
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.RemoveFile(newFile.name)
+	if err != nil {
+		t.Fatalf("RemoveFile returned error: %v", err)
+	}
+	zf.Close()
+	data, err = afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	if !bytes.HasPrefix(data, stub) {
+		t.Error("Archive rewritten after reopening doesn't start with the stub")
+	}
+	verifyZipFile(t, fs, zipFileName, "", files)
+	verifyReadBack(t, fs, zipFileName, files)
+}
+
+func TestTrailingBytes(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "archive comment", files)
+
+	// Append a signature block after the end of central directory record
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	err = makeTestFile(fs, zipFileName, append(data, []byte("-----BEGIN SIGNATURE-----\nAAAA\n")...))
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	if zf.Comment() != "archive comment" {
+		t.Errorf("Comment: %q; Want: %q", zf.Comment(), "archive comment")
+	}
+	for _, f := range files {
+		fileData, err := zf.ReadFile(f.name)
+		if err != nil {
+			t.Errorf("ReadFile(%s) returned error: %v", f.name, err)
+		} else if !bytes.Equal(fileData, f.data) {
+			t.Errorf("ReadFile(%s) returned %q; Want: %q", f.name, fileData, f.data)
+		}
+	}
+}
+
+func TestReadDirectoryFakeEOCDInComment(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+
+	// The comment ends with what looks like an end of central directory record for an
+	// archive with one file and no comment
+	fakeEOCD := []byte("PK\x05\x06\x00\x00\x00\x00\x01\x00\x01\x00\x2e\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	comment := "Tricky comment: " + string(fakeEOCD)
+	makeZipFile(t, fs, zipFileName, comment, files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	if string(zf.comment) != comment {
+		t.Errorf("zf.comment is %q; Want: %q", zf.comment, comment)
+	}
+	if len(zf.List()) != len(files) {
+		t.Errorf("List returned %d entries; Want: %d", len(zf.List()), len(files))
+	}
+}
+
+func TestOpenEntry(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	modified := time.Date(2024, 11, 30, 9, 20, 0, 0, time.Local)
+
+	zipFile, err := fs.Create(zipFileName)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	header := zip.FileHeader{Name: "dir/script.sh", Method: zip.Store, Modified: modified}
+	header.SetMode(0755)
+	writer, err := zipWriter.CreateHeader(&header)
+	if err != nil {
+		t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+	}
+	fileData := []byte("#!/bin/sh\necho hello\n")
+	writer.Write(fileData)
+	zipWriter.Close()
+	zipFile.Close()
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	f, err := zf.OpenEntry("dir/script.sh")
+	if err != nil {
+		t.Fatalf("OpenEntry returned error: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatalf("Stat returned error: %v", err)
+	}
+	if info.Name() != "script.sh" || info.Size() != int64(len(fileData)) || info.Mode() != 0755 || info.IsDir() {
+		t.Errorf("Stat returned %s, %d, %v, %v; Want: script.sh, %d, %v, false",
+			info.Name(), info.Size(), info.Mode(), info.IsDir(), len(fileData), os.FileMode(0755))
+	}
+	if !info.ModTime().Equal(modified) {
+		t.Errorf("Stat returned ModTime %v; Want: %v", info.ModTime(), modified)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("io.ReadAll returned error: %v", err)
+	}
+	if !bytes.Equal(data, fileData) {
+		t.Errorf("io.ReadAll returned %q; Want: %q", data, fileData)
+	}
+
+	_, err = zf.OpenEntry("missing.txt")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("OpenEntry returned %v; Want: %v", err, ErrFileNotFound)
+	}
+}
+
+func TestOpenEntryClose(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	data := bytes.Repeat([]byte("This file is compressed with zstd. "), 100)
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter returned error: %v", err)
+	}
+	compressed := encoder.EncodeAll(data, nil)
+	encoder.Close()
+	makeCompressedZipFile(t, fs, zipFileName, "file1.txt", COMPRESS_ZSTD, data, compressed)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	f, err := zf.OpenEntry("file1.txt")
+	if err != nil {
+		t.Fatalf("OpenEntry returned error: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	// Close released the decompressor, so it can't be read any more
+	_, err = f.Read(make([]byte, 10))
+	if err == nil {
+		t.Error("Read after Close should return an error")
+	}
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	stored := []byte("This archive contains some text files.")
+	makeZipFile(t, fs, zipFileName, "", []testfile{{"stored.txt", "", stored}})
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	deflated := bytes.Repeat([]byte("Deflated data. "), 100)
+	err = zf.AddBytes("deflated.txt", deflated, COMPRESS_DEFLATED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+
+	for _, f := range []testfile{{"stored.txt", "", stored}, {"deflated.txt", "", deflated}} {
+		r, size, err := zf.OpenReaderAt(f.name)
+		if err != nil {
+			t.Fatalf("OpenReaderAt(%s) returned error: %v", f.name, err)
+		}
+		if size != int64(len(f.data)) {
+			t.Errorf("OpenReaderAt(%s) returned size %d; Want: %d", f.name, size, len(f.data))
+		}
+		p := make([]byte, 10)
+		_, err = r.ReadAt(p, 5)
+		if err != nil {
+			t.Errorf("ReadAt returned error: %v", err)
+		} else if !bytes.Equal(p, f.data[5:15]) {
+			t.Errorf("ReadAt returned %q; Want: %q", p, f.data[5:15])
+		}
+		_, err = r.ReadAt(p, size-5)
+		if err != io.EOF {
+			t.Errorf("ReadAt past the end returned %v; Want: %v", err, io.EOF)
+		}
+	}
+
+	_, _, err = zf.OpenReaderAt("missing.txt")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("OpenReaderAt returned %v; Want: %v", err, ErrFileNotFound)
+	}
+}
+
+func TestOpenReaderAtSizeMismatch(t *testing.T) {
+	// The header says the stored file is bigger than its data, which would read into
+	// the central directory after it
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	makeCompressedZipFile(t, fs, zipFileName, "stored.txt", COMPRESS_STORED, bytes.Repeat([]byte("x"), 60), []byte("short"))
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	_, _, err = zf.OpenReaderAt("stored.txt")
+	if err == nil {
+		t.Error("OpenReaderAt should have failed, but didn't")
+	}
+}
+
+func TestOpenRaw(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	fileData := bytes.Repeat([]byte("Deflated data. "), 100)
+	compressed, err := deflateData(context.Background(), bytes.NewReader(fileData), flate.DefaultCompression)
+	if err != nil {
+		t.Fatalf("deflateData returned error: %v", err)
+	}
+	makeCompressedZipFile(t, fs, zipFileName, "deflated.txt", COMPRESS_DEFLATED, fileData, compressed)
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	r, entry, err := zf.OpenRaw("deflated.txt")
+	if err != nil {
+		t.Fatalf("OpenRaw returned error: %v", err)
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("io.ReadAll returned error: %v", err)
+	}
+	if !bytes.Equal(raw, compressed) {
+		t.Errorf("OpenRaw returned %d bytes of data; Want the %d compressed bytes", len(raw), len(compressed))
+	}
+	if entry.Name != "deflated.txt" || entry.Method != COMPRESS_DEFLATED || entry.CompressedSize != uint32(len(compressed)) ||
+		entry.UncompressedSize != uint32(len(fileData)) || entry.CRC32 != crc32.ChecksumIEEE(fileData) {
+		t.Errorf("OpenRaw returned entry %+v; Want the file's metadata", entry)
+	}
+
+	_, _, err = zf.OpenRaw("missing.txt")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("OpenRaw returned %v; Want: %v", err, ErrFileNotFound)
+	}
+}
+
+func TestWriteFileTo(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	for _, f := range files {
+		var buf bytes.Buffer
+		n, err := zf.WriteFileTo(f.name, &buf)
+		if err != nil {
+			t.Errorf("WriteFileTo(%s) returned error: %v", f.name, err)
+		}
+		if n != int64(len(f.data)) || !bytes.Equal(buf.Bytes(), f.data) {
+			t.Errorf("WriteFileTo(%s) wrote %d bytes %q; Want: %d bytes %q", f.name, n, buf.Bytes(), len(f.data), f.data)
+		}
+	}
+	_, err = zf.WriteFileTo("missing.txt", io.Discard)
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("WriteFileTo returned %v; Want: %v", err, ErrFileNotFound)
+	}
+
+	// Nothing was written to disk
+	for _, f := range files {
+		exists, _ := afero.Exists(fs, f.name)
+		if exists {
+			t.Errorf("%s shouldn't exist after WriteFileTo", f.name)
+		}
+	}
+}
+
+func TestFileNameEncoding(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+
+	zipFile, err := fs.Create(zipFileName)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	// "café.txt" in CP437, without the UTF-8 flag
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "caf\x82.txt", Method: zip.Store, NonUTF8: true})
+	if err != nil {
+		t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+	}
+	writer.Write([]byte("CP437 name"))
+	// UTF-8, with the flag
+	writer, err = zipWriter.CreateHeader(&zip.FileHeader{Name: "naïve.txt", Method: zip.Store})
+	if err != nil {
+		t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+	}
+	writer.Write([]byte("UTF-8 name"))
+	zipWriter.Close()
+	zipFile.Close()
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	expNames := []string{"café.txt", "naïve.txt"}
+	for i, e := range zf.List() {
+		if e.Name != expNames[i] {
+			t.Errorf("List returned name %q; Want: %q", e.Name, expNames[i])
+		}
+	}
+
+	// Rewriting the archive marks the non-ASCII names as UTF-8
+	err = zf.AddBytes("日本.txt", []byte("New UTF-8 name"), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "", []testfile{
+		{"café.txt", "", []byte("CP437 name")},
+		{"naïve.txt", "", []byte("UTF-8 name")},
+		{"日本.txt", "", []byte("New UTF-8 name")},
+	})
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	for _, f := range zipReader.File {
+		if f.Flags&FLAG_UTF8 == 0 {
+			t.Errorf("%s doesn't have the UTF-8 flag", f.Name)
+		}
+	}
+}
+
+func TestContainsAndNames(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"manifest.json", "", []byte("{}")},
+		{"dir/", "", []byte{}},
+		{"dir/file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	expNames := []string{"manifest.json", "dir/", "dir/file1.txt"}
+	if !reflect.DeepEqual(zf.Names(), expNames) {
+		t.Errorf("Names returned %q; Want: %q", zf.Names(), expNames)
+	}
+	var testcases = []struct {
+		name     string
+		expected bool
+	}{
+		{"manifest.json", true},
+		{"dir/file1.txt", true},
+		{"file1.txt", false},
+		{"dir", false},
+		{"MANIFEST.JSON", false},
+	}
+	for _, c := range testcases {
+		if zf.Contains(c.name) != c.expected {
+			t.Errorf("Contains(%q) returned %v; Want: %v", c.name, !c.expected, c.expected)
+		}
+	}
+}
+
+func TestGetEntry(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"manifest.json", "", []byte("{}")},
+		{"dir/file1.txt", "A comment", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	e, ok := zf.GetEntry("dir/file1.txt")
+	if !ok {
+		t.Fatal("GetEntry didn't find dir/file1.txt")
+	}
+	if !reflect.DeepEqual(e, zf.List()[1]) {
+		t.Errorf("GetEntry returned %v; Want: %v", e, zf.List()[1])
+	}
+	if e.CRC32 != crc32.ChecksumIEEE(files[1].data) || e.UncompressedSize != uint32(len(files[1].data)) || e.Comment != "A comment" {
+		t.Errorf("GetEntry returned %v; Want the CRC, size, and comment of dir/file1.txt", e)
+	}
+
+	// The entry is a copy
+	e.Comment = "Changed"
+	comment, _ := zf.FileComment("dir/file1.txt")
+	if comment != "A comment" {
+		t.Errorf("Changing the entry changed the comment to %q", comment)
+	}
+
+	_, ok = zf.GetEntry("file1.txt")
+	if ok {
+		t.Error("GetEntry found a file that isn't in the archive")
+	}
+}
+
+func TestForEach(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+		{"fileThree.txt", "", []byte("File number 3")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	// Stop at the second file
+	errFound := errors.New("found it")
+	visited := []string{}
+	err = zf.ForEach(func(e Entry) error {
+		visited = append(visited, e.Name)
+		e.Name = "changed" // Shouldn't change the archive
+		if len(visited) == 2 {
+			return errFound
+		}
+		return nil
+	})
+	if err != errFound {
+		t.Errorf("ForEach returned %v; Want: %v", err, errFound)
+	}
+	if !reflect.DeepEqual(visited, []string{files[0].name, files[1].name}) {
+		t.Errorf("ForEach visited %q; Want: %q", visited, []string{files[0].name, files[1].name})
+	}
+	if zf.List()[0].Name != files[0].name {
+		t.Errorf("List returned %s after ForEach; Want: %s", zf.List()[0].Name, files[0].name)
+	}
+}
+
+func TestUpdateFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "beta comment", []byte("Second file in the archive.")},
+		{"fileThree.txt", "", []byte("File number 3")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.UpdateFile(files[1].name, strings.NewReader("Updated second file."), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("UpdateFile returned error: %v", err)
+	}
+	err = zf.UpdateFile("missing.txt", strings.NewReader("data"), COMPRESS_STORED)
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("UpdateFile returned %v; Want: %v", err, ErrFileNotFound)
+	}
+	zf.Close()
+
+	files[1].data = []byte("Updated second file.")
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestRenameEntry(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"old/path.txt", "a comment", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.RenameEntry("old/path.txt", "a/much/longer/new/path.txt")
+	if err != nil {
+		t.Fatalf("RenameEntry returned error: %v", err)
+	}
+	err = zf.RenameEntry("missing.txt", "new.txt")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("RenameEntry returned %v; Want: %v", err, ErrFileNotFound)
+	}
+	err = zf.RenameEntry(files[1].name, "a/much/longer/new/path.txt")
+	if !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("RenameEntry returned %v; Want: %v", err, ErrDuplicateName)
+	}
+	err = zf.RenameEntry(files[1].name, "./a/much//longer/new/path.txt")
+	if !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("RenameEntry to an uncleaned name returned %v; Want: %v", err, ErrDuplicateName)
+	}
+	for _, name := range []string{"../../evil.txt", "a/../../evil.txt"} {
+		err = zf.RenameEntry(files[1].name, name)
+		if !errors.Is(err, ErrInsecurePath) {
+			t.Errorf("RenameEntry(%s) returned %v; Want: %v", name, err, ErrInsecurePath)
+		}
+	}
+	// The renamed file can still be read before the archive is reopened
+	data, err := zf.ReadFile("a/much/longer/new/path.txt")
+	if err != nil || !bytes.Equal(data, files[0].data) {
+		t.Errorf("ReadFile returned %q, %v; Want: %q", data, err, files[0].data)
+	}
+	zf.Close()
+
+	files[0].name = "a/much/longer/new/path.txt"
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestMerge(t *testing.T) {
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"shared.txt", "from first", []byte("Shared file in the first archive.")},
+	}
+	// The other archive's files are deflated, by archive/zip and by this package
+	otherFiles := []testfile{
+		{"shared.txt", "from other", []byte("Shared file in the other archive.")},
+		{"dir/other.txt", "", bytes.Repeat([]byte("Only in the other archive. "), 50)},
+		{"deflated.txt", "", bytes.Repeat([]byte("Deflated by this package. "), 50)},
+	}
+
+	var testcases = []struct {
+		policy   ConflictPolicy
+		expErr   error
+		expFiles []testfile
+	}{
+		{CONFLICT_SKIP, nil, []testfile{files[0], files[1], otherFiles[1], otherFiles[2]}},
+		{CONFLICT_OVERWRITE, nil, []testfile{files[0], otherFiles[0], otherFiles[1], otherFiles[2]}},
+		{CONFLICT_ERROR, ErrDuplicateName, files},
+	}
+	for _, c := range testcases {
+		fs := afero.NewMemMapFs()
+		makeZipFile(t, fs, "first.zip", "", files)
+		makeZipFileWithMethod(t, fs, "other.zip", "", otherFiles[:2], zip.Deflate)
+		other, err := OpenWithFs("other.zip", fs)
+		if err != nil {
+			t.Fatalf("OpenWithFs returned error: %v", err)
+		}
+		err = other.AddBytes(otherFiles[2].name, otherFiles[2].data, COMPRESS_DEFLATED)
+		if err != nil {
+			t.Fatalf("AddBytes returned error: %v", err)
+		}
+		other.Close()
+
+		zf, err := OpenWithFs("first.zip", fs)
+		if err != nil {
+			t.Fatalf("OpenWithFs returned error: %v", err)
+		}
+		other, err = OpenWithFs("other.zip", fs)
+		if err != nil {
+			t.Fatalf("OpenWithFs returned error: %v", err)
+		}
+		err = zf.Merge(other, c.policy)
+		if !errors.Is(err, c.expErr) {
+			t.Errorf("Merge with policy %d returned %v; Want: %v", c.policy, err, c.expErr)
+		}
+		other.Close()
+		zf.Close()
+
+		verifyZipFile(t, fs, "first.zip", "", c.expFiles)
+		verifyReadBack(t, fs, "first.zip", c.expFiles)
+	}
+}
+
+func TestMergeComment(t *testing.T) {
+	files := []testfile{{"file1.txt", "", []byte("This archive contains some text files.")}}
+	otherFiles := []testfile{{"other.txt", "", []byte("A file in the other archive.")}}
+
+	var testcases = []struct {
+		opts       MergeOptions
+		expComment string
+	}{
+		{MergeOptions{}, ""},
+		{MergeOptions{CommentPolicy: COMMENT_FIRST}, "First comment"},
+		{MergeOptions{CommentPolicy: COMMENT_CONCAT}, "First comment\nOther comment"},
+		{MergeOptions{CommentPolicy: COMMENT_CUSTOM, Comment: "Merged"}, "Merged"},
+	}
+	for _, c := range testcases {
+		fs := afero.NewMemMapFs()
+		makeZipFile(t, fs, "first.zip", "First comment", files)
+		makeZipFile(t, fs, "other.zip", "Other comment", otherFiles)
+		zf, err := OpenWithFs("first.zip", fs)
+		if err != nil {
+			t.Fatalf("OpenWithFs returned error: %v", err)
+		}
+		other, err := OpenWithFs("other.zip", fs)
+		if err != nil {
+			t.Fatalf("OpenWithFs returned error: %v", err)
+		}
+		err = zf.MergeWithOptions(other, c.opts)
+		if err != nil {
+			t.Errorf("MergeWithOptions with comment policy %d returned error: %v", c.opts.CommentPolicy, err)
+		}
+		if zf.Comment() != c.expComment {
+			t.Errorf("Comment with comment policy %d is %q; Want: %q", c.opts.CommentPolicy, zf.Comment(), c.expComment)
+		}
+		other.Close()
+		zf.Close()
+		verifyZipFile(t, fs, "first.zip", c.expComment, append(slices.Clone(files), otherFiles...))
+	}
+
+	// A failed merge leaves the comment as it was
+	fs := afero.NewMemMapFs()
+	makeZipFile(t, fs, "first.zip", "First comment", files)
+	makeZipFile(t, fs, "other.zip", "Other comment", files)
+	zf, err := OpenWithFs("first.zip", fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	other, err := OpenWithFs("other.zip", fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer other.Close()
+	err = zf.MergeWithOptions(other, MergeOptions{OnConflict: CONFLICT_ERROR, CommentPolicy: COMMENT_CONCAT})
+	if !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("MergeWithOptions returned %v; Want: %v", err, ErrDuplicateName)
+	}
+	if zf.Comment() != "First comment" {
+		t.Errorf("Comment after failed merge is %q; Want: %q", zf.Comment(), "First comment")
+	}
+}
+
+func TestCopyEntryFrom(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	srcFiles := []testfile{
+		{"picked.txt", "picked comment", bytes.Repeat([]byte("The file to copy. "), 50)},
+		{"ignored.txt", "", []byte("A file to leave behind.")},
+	}
+	makeZipFile(t, fs, "dest.zip", "", files)
+	makeZipFileWithMethod(t, fs, "src.zip", "", srcFiles, zip.Deflate)
+
+	zf, err := OpenWithFs("dest.zip", fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	src, err := OpenWithFs("src.zip", fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer src.Close()
+	err = zf.CopyEntryFrom(src, "picked.txt")
+	if err != nil {
+		t.Fatalf("CopyEntryFrom returned error: %v", err)
+	}
+	err = zf.CopyEntryFrom(src, "missing.txt")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("CopyEntryFrom returned %v; Want: %v", err, ErrFileNotFound)
+	}
+
+	// The copied file has the same metadata as the original
+	srcEntry := src.List()[0]
+	srcEntry.Flags &^= FLAG_DATA_DESCRIPTOR // The copy has its sizes in its local header
+	copiedEntry := zf.List()[1]
+	if !reflect.DeepEqual(copiedEntry, srcEntry) {
+		t.Errorf("Copied entry is %+v; Want: %+v", copiedEntry, srcEntry)
+	}
+
+	// A file deflated by this package copies too
+	ownFile := testfile{"own.txt", "", bytes.Repeat([]byte("Deflated by this package. "), 50)}
+	err = zf.AddBytes(ownFile.name, ownFile.data, COMPRESS_DEFLATED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+	other, err := CreateEmptyWithFs(fs, "other.zip")
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	err = other.CopyEntryFrom(zf, ownFile.name)
+	if err != nil {
+		t.Fatalf("CopyEntryFrom returned error: %v", err)
+	}
+	other.Close()
+	zf.Close()
+
+	expFiles := []testfile{files[0], srcFiles[0], ownFile}
+	verifyZipFile(t, fs, "dest.zip", "", expFiles)
+	verifyReadBack(t, fs, "dest.zip", expFiles)
+	verifyZipFile(t, fs, "other.zip", "", []testfile{ownFile})
+	verifyReadBack(t, fs, "other.zip", []testfile{ownFile})
+}
+
+// countdownContext is a context that's cancelled after Err has been called n times, for
+// cancelling in the middle of an operation.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n <= 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestContextCancel(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"big.txt", "", bytes.Repeat([]byte("A big file that takes several reads to copy. "), 5000)},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	makeTestFile(fs, "fileToAdd.txt", []byte("File to add"))
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	var testcases = []struct {
+		operation string
+		ctx       context.Context
+	}{
+		{"ExtractAllContext", cancelled},
+		{"ExtractAllContext", &countdownContext{context.Background(), 2}},
+		{"VerifyAllContext", cancelled},
+		{"VerifyAllContext", &countdownContext{context.Background(), 2}},
+		{"AddFileContext", cancelled},
+		{"AddFileContext", &countdownContext{context.Background(), 2}},
+	}
+	for _, c := range testcases {
+		switch c.operation {
+		case "ExtractAllContext":
+			err = zf.ExtractAllContext(c.ctx)
+		case "VerifyAllContext":
+			err = zf.VerifyAllContext(c.ctx)
+		case "AddFileContext":
+			err = zf.AddFileContext(c.ctx, "fileToAdd.txt", COMPRESS_STORED)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s returned %v; Want: %v", c.operation, err, context.Canceled)
+		}
+	}
+	zf.Close()
+
+	// Nothing is left behind, and the archive is unchanged
+	exists, _ := afero.Exists(fs, files[0].name)
+	if exists {
+		t.Errorf("%s shouldn't exist after cancelling", files[0].name)
+	}
+	for _, name := range []string{files[0].name, zipFileName} {
+		if temps := tempFiles(t, fs, name); len(temps) > 0 {
+			t.Errorf("%v shouldn't exist after cancelling", temps)
+		}
+	}
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestContextCancelDeflate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	big := bytes.Repeat([]byte("A big file that takes several reads to compress. "), 5000)
+	makeTestFile(fs, "big.txt", big)
+
+	// Cancelled in the middle of compressing the file
+	_, err := deflateData(&countdownContext{context.Background(), 1}, bytes.NewReader(big), flate.DefaultCompression)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("deflateData returned %v; Want: %v", err, context.Canceled)
+	}
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	err = zf.AddFileContext(&countdownContext{context.Background(), 2}, "big.txt", COMPRESS_DEFLATED)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("AddFileContext returned %v; Want: %v", err, context.Canceled)
+	}
+	zf.Close()
+	if temps := tempFiles(t, fs, zipFileName); len(temps) > 0 {
+		t.Errorf("%v shouldn't exist after cancelling", temps)
+	}
+	verifyZipFile(t, fs, zipFileName, "", nil)
+}
+
+func TestExtractAllWithProgress(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"big.txt", "", bytes.Repeat([]byte("A big file that takes several writes. "), 5000)},
+		{"empty.txt", "", []byte{}},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	var total int64
+	for _, f := range files {
+		total += int64(len(f.data))
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	started := []string{}
+	var lastDone int64
+	err = zf.ExtractAllWithProgress(func(name string, bytesDone int64, bytesTotal int64) {
+		if len(started) == 0 || started[len(started)-1] != name {
+			started = append(started, name)
+		}
+		if bytesTotal != total {
+			t.Errorf("Progress reported total %d; Want: %d", bytesTotal, total)
+		}
+		if bytesDone < lastDone || bytesDone > total {
+			t.Errorf("Progress reported %d bytes done after %d", bytesDone, lastDone)
+		}
+		lastDone = bytesDone
+	})
+	if err != nil {
+		t.Fatalf("ExtractAllWithProgress returned error: %v", err)
+	}
+	if lastDone != total {
+		t.Errorf("Progress ended at %d bytes; Want: %d", lastDone, total)
+	}
+	expStarted := []string{files[0].name, files[1].name, files[2].name}
+	if !reflect.DeepEqual(started, expStarted) {
+		t.Errorf("Progress reported files %q; Want: %q", started, expStarted)
+	}
+}
+
+func TestExtractAllContinue(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+		{"fileThree.txt", "", []byte("File number 3")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	// Corrupt the first file's data
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	i := bytes.Index(data, files[0].data)
+	data[i] = 'X'
+	err = makeTestFile(fs, zipFileName, data)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.ExtractAllContinue()
+	if err == nil || !strings.Contains(err.Error(), files[0].name) {
+		t.Errorf("ExtractAllContinue returned %v; Want: an error naming %s", err, files[0].name)
+	}
+
+	// The good files were still extracted
+	exists, _ := afero.Exists(fs, files[0].name)
+	if exists {
+		t.Errorf("%s shouldn't exist after a failed extract", files[0].name)
+	}
+	for _, f := range files[1:] {
+		fileData, err := afero.ReadFile(fs, f.name)
+		if err != nil {
+			t.Errorf("afero.ReadFile returned error: %v", err)
+		} else if !bytes.Equal(fileData, f.data) {
+			t.Errorf("%s has data %q; Want: %q", f.name, fileData, f.data)
+		}
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{}
+	for i := 0; i < 8; i++ {
+		files = append(files, testfile{fmt.Sprintf("file%d.txt", i), "", bytes.Repeat([]byte{byte('a' + i)}, 10000+i)})
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	var wg sync.WaitGroup
+	for round := 0; round < 20; round++ {
+		for _, f := range files {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, err := zf.ReadFile(f.name)
+				if err != nil {
+					t.Errorf("ReadFile(%s) returned error: %v", f.name, err)
+				} else if !bytes.Equal(data, f.data) {
+					t.Errorf("ReadFile(%s) returned the wrong data", f.name)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestOpenLazy(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+
+	// Give the first file a local extra field, so that finding its data depends on
+	// reading its local header
+	zipFile, err := fs.Create(zipFileName)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	for i, f := range files {
+		header := zip.FileHeader{Name: f.name, Method: zip.Store}
+		if i == 0 {
+			header.Extra = []byte("\xfe\xca\x04\x00abcd")
+		}
+		writer, err := zipWriter.CreateHeader(&header)
+		if err != nil {
+			t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+		}
+		writer.Write(f.data)
+	}
+	zipWriter.Close()
+	zipFile.Close()
+
+	// Break the second file's local header signature
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	i := bytes.LastIndex(data, []byte("PK\x03\x04"))
+	data[i+3] = 0xff
+	err = makeTestFile(fs, zipFileName, data)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+
+	_, err = OpenWithFs(zipFileName, fs)
+	if err == nil {
+		t.Error("OpenWithFs should fail with a bad local header")
+	}
+	zf, err := OpenLazyWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenLazyWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	if !reflect.DeepEqual(zf.Names(), []string{files[0].name, files[1].name}) {
+		t.Errorf("Names returned %q; Want: %q", zf.Names(), []string{files[0].name, files[1].name})
+	}
+	fileData, err := zf.ReadFile(files[0].name)
+	if err != nil || !bytes.Equal(fileData, files[0].data) {
+		t.Errorf("ReadFile returned %q, %v; Want: %q", fileData, err, files[0].data)
+	}
+	err = zf.ExtractFile(files[1].name)
+	if err == nil {
+		t.Error("ExtractFile should fail with a bad local header")
+	}
+
+	// Rewriting reads the local headers it needs
+	err = zf.RemoveFile(files[1].name)
+	if err != nil {
+		t.Fatalf("RemoveFile returned error: %v", err)
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "", files[:1])
+}
+
+func TestExtractAllN(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"dir/", "", []byte{}},
+		{"dir/filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	n, err := zf.ExtractAllN()
+	if err != nil {
+		t.Fatalf("ExtractAllN returned error: %v", err)
+	}
+	want := int64(len(files[0].data) + len(files[2].data))
+	if n != want {
+		t.Errorf("ExtractAllN returned %d bytes; Want: %d", n, want)
+	}
+
+	n, err = zf.ExtractFileN(files[2].name)
+	if err != nil {
+		t.Fatalf("ExtractFileN returned error: %v", err)
+	}
+	if n != int64(len(files[2].data)) {
+		t.Errorf("ExtractFileN returned %d bytes; Want: %d", n, len(files[2].data))
+	}
+	_, err = zf.ExtractFileN("missing.txt")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("ExtractFileN returned %v; Want: %v", err, ErrFileNotFound)
+	}
+}
+
+func TestExtractBzip2(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	data := []byte("This file is compressed with bzip2.")
+	compressed := []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xf3\x14\x9f\xc9\x00\x00\x03\x9b\x80\x40\x01\x10\x00\x04\x00\x1f\x66\xdc\x90\x20\x00\x22\x23\x4d\x1a\x68\x68\xd1\xea\x14\xc2\x69\xa0\x34\xc4\x68\x26\x6b\x71\x54\xaa\xeb\x09\xdc\xec\x23\x8e\x8f\x18\x83\x27\xe1\xb0\xf8\xbb\x92\x29\xc2\x84\x87\x98\xa4\xfe\x48")
+	makeCompressedZipFile(t, fs, zipFileName, "file1.txt", COMPRESS_BZIP2, data, compressed)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	err = zf.ExtractFile("file1.txt")
+	if err != nil {
+		t.Fatalf("ExtractFile returned error: %v", err)
+	}
+	fileData, err := afero.ReadFile(fs, "file1.txt")
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	if !bytes.Equal(fileData, data) {
+		t.Errorf("Extracted %q; Want: %q", fileData, data)
+	}
+	err = zf.VerifyAll()
+	if err != nil {
+		t.Errorf("VerifyAll returned error: %v", err)
+	}
+}
+
+func TestExtractZstd(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	data := bytes.Repeat([]byte("This file is compressed with zstd. "), 100)
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter returned error: %v", err)
+	}
+	compressed := encoder.EncodeAll(data, nil)
+	encoder.Close()
+	makeCompressedZipFile(t, fs, zipFileName, "file1.txt", COMPRESS_ZSTD, data, compressed)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	fileData, err := zf.ReadFile("file1.txt")
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+	if !bytes.Equal(fileData, data) {
+		t.Errorf("ReadFile returned %q; Want: %q", fileData, data)
+	}
+	err = zf.ExtractAll()
+	if err != nil {
+		t.Fatalf("ExtractAll returned error: %v", err)
+	}
+	fileData, err = afero.ReadFile(fs, "file1.txt")
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	if !bytes.Equal(fileData, data) {
+		t.Errorf("Extracted %q; Want: %q", fileData, data)
+	}
+}
+
+func TestExtractUnsupportedMethod(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	data := []byte("This file is compressed with LZMA.")
+	makeCompressedZipFile(t, fs, zipFileName, "file1.txt", 14, data, []byte("not really LZMA"))
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	err = zf.ExtractFile("file1.txt")
+	if !errors.Is(err, ErrUnsupportedMethod) {
+		t.Fatalf("ExtractFile returned %v; Want: ErrUnsupportedMethod", err)
+	}
+	if !strings.Contains(err.Error(), `unsupported compression method 14 (LZMA) for entry "file1.txt"`) {
+		t.Errorf("ExtractFile error %q doesn't name the method and entry", err)
+	}
+	exists, _ := afero.Exists(fs, "file1.txt")
+	if exists {
+		t.Error("ExtractFile shouldn't create a file for an unsupported method")
+	}
+}
+
+func TestTotals(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	data := bytes.Repeat([]byte("This file is compressed with zstd. "), 100)
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter returned error: %v", err)
+	}
+	compressed := encoder.EncodeAll(data, nil)
+	encoder.Close()
+	makeCompressedZipFile(t, fs, zipFileName, "file1.txt", COMPRESS_ZSTD, data, compressed)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.AddBytes("file2.txt", []byte("Stored file."), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+
+	if zf.NumEntries() != 2 {
+		t.Errorf("NumEntries returned %d; Want: 2", zf.NumEntries())
+	}
+	expCompressed := int64(len(compressed) + len("Stored file."))
+	if zf.TotalCompressedSize() != expCompressed {
+		t.Errorf("TotalCompressedSize returned %d; Want: %d", zf.TotalCompressedSize(), expCompressed)
+	}
+	expUncompressed := int64(len(data) + len("Stored file."))
+	if zf.TotalUncompressedSize() != expUncompressed {
+		t.Errorf("TotalUncompressedSize returned %d; Want: %d", zf.TotalUncompressedSize(), expUncompressed)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	data := []byte("This file is compressed with zstd.")
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter returned error: %v", err)
+	}
+	compressed := encoder.EncodeAll(data, nil)
+	encoder.Close()
+	makeCompressedZipFile(t, fs, zipFileName, "file1.txt", COMPRESS_ZSTD, data, compressed)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.AddBytes("file2.txt", []byte("Stored file."), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+	err = zf.AddBytes("file3.txt", []byte("Another stored file."), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+
+	expected := []CompressionMethod{COMPRESS_ZSTD, COMPRESS_STORED}
+	if !slices.Equal(zf.Methods(), expected) {
+		t.Errorf("Methods returned %v; Want: %v", zf.Methods(), expected)
+	}
+}
+
+func TestDisplayFooter(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+		{"empty.txt", "", []byte{}},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	var output bytes.Buffer
+	zf.Display(&output)
+	lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	footer := strings.Fields(lines[len(lines)-1])
+	expFooter := []string{"65", "65", "100%", "3", "files"}
+	if !reflect.DeepEqual(footer, expFooter) {
+		t.Errorf("Display footer is %q; Want: %q", footer, expFooter)
+	}
+	if !strings.Contains(lines[len(lines)-3], " 0% ") {
+		t.Errorf("Display line %q should show 0%% for an empty file", lines[len(lines)-3])
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		exp  string
+	}{
+		{0, "0"},
+		{1023, "1023"},
+		{1024, "1.0K"},
+		{1228, "1.2K"},
+		{1229, "1.3K"},
+		{1025, "1.1K"},
+		{10*1024 - 1, "10K"},
+		{34 * 1024 * 1024, "34M"},
+		{1024*1024 - 1, "1.0M"},
+		{2254857830, "2.1G"},
+	}
+	for _, test := range tests {
+		if got := humanSize(test.size); got != test.exp {
+			t.Errorf("humanSize(%d) returned %q; Want: %q", test.size, got, test.exp)
+		}
+	}
+
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", bytes.Repeat([]byte("x"), 1536)},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	var output bytes.Buffer
+	zf.DisplayHuman(&output)
+	for _, line := range strings.Split(output.String(), "\n") {
+		if strings.HasSuffix(line, files[0].name) && !strings.HasPrefix(strings.Join(strings.Fields(line), " "), "1.5K stored 1.5K") {
+			t.Errorf("DisplayHuman line %q should show 1.5K sizes", line)
+		}
+	}
+}
+
+func TestDisplayJSON(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "first comment", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	var output bytes.Buffer
+	err = zf.DisplayJSON(&output)
+	if err != nil {
+		t.Fatalf("DisplayJSON returned error: %v", err)
+	}
+	var entries []map[string]any
+	err = json.Unmarshal(output.Bytes(), &entries)
+	if err != nil {
+		t.Fatalf("DisplayJSON output isn't valid JSON: %v\n%s", err, output.String())
+	}
+	if len(entries) != len(files) {
+		t.Fatalf("DisplayJSON returned %d entries; Want: %d", len(entries), len(files))
+	}
+	for i, f := range files {
+		e := entries[i]
+		if e["name"] != f.name || e["comment"] != f.comment || e["method"] != "stored" {
+			t.Errorf("DisplayJSON entry %d is %v", i, e)
+		}
+		if e["uncompressedSize"] != float64(len(f.data)) || e["compressedSize"] != float64(len(f.data)) {
+			t.Errorf("DisplayJSON entry %d has sizes %v and %v; Want: %d", i, e["uncompressedSize"], e["compressedSize"], len(f.data))
+		}
+		if e["crc32"] != fmt.Sprintf("%08x", crc32.ChecksumIEEE(f.data)) {
+			t.Errorf("DisplayJSON entry %d has CRC %v; Want: %08x", i, e["crc32"], crc32.ChecksumIEEE(f.data))
+		}
+		_, err = time.Parse(time.RFC3339, e["modified"].(string))
+		if err != nil {
+			t.Errorf("DisplayJSON entry %d has modified time %v that isn't RFC 3339: %v", i, e["modified"], err)
+		}
+	}
+}
+
+func TestBackslashNames(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	fileData := []byte("This file was zipped on Windows.")
+	makeZipFile(t, fs, zipFileName, "", []testfile{{"dir\\sub\\file1.txt", "", fileData}})
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	if !zf.Contains("dir/sub/file1.txt") {
+		t.Errorf("Names returned %v; Want: [dir/sub/file1.txt]", zf.Names())
+	}
+	err = zf.ExtractFile("dir/sub/file1.txt")
+	if err != nil {
+		t.Fatalf("ExtractFile returned error: %v", err)
+	}
+	extracted, err := afero.ReadFile(fs, filepath.Join("dir", "sub", "file1.txt"))
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	if !bytes.Equal(extracted, fileData) {
+		t.Errorf("Extracted file has %q; Want: %q", extracted, fileData)
+	}
+
+	// The name is only changed in the archive when it's rewritten
+	verifyZipFile(t, fs, zipFileName, "", []testfile{{"dir\\sub\\file1.txt", "", fileData}})
+	err = zf.Save()
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	verifyZipFile(t, fs, zipFileName, "", []testfile{{"dir/sub/file1.txt", "", fileData}})
+}
+
+func TestExtractTo(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"dir/filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	err = zf.ExtractAllTo("out/all")
+	if err != nil {
+		t.Fatalf("ExtractAllTo returned error: %v", err)
+	}
+	for _, f := range files {
+		fileData, err := afero.ReadFile(fs, "out/all/"+f.name)
+		if err != nil {
+			t.Errorf("afero.ReadFile(%s) returned error: %v", f.name, err)
+		} else if !bytes.Equal(fileData, f.data) {
+			t.Errorf("Extracted %q; Want: %q", fileData, f.data)
+		}
+		exists, _ := afero.Exists(fs, f.name)
+		if exists {
+			t.Errorf("ExtractAllTo shouldn't extract %s to the current directory", f.name)
+		}
+	}
+
+	err = zf.ExtractFileTo(files[1].name, "out/one")
+	if err != nil {
+		t.Fatalf("ExtractFileTo returned error: %v", err)
+	}
+	fileData, err := afero.ReadFile(fs, "out/one/"+files[1].name)
+	if err != nil || !bytes.Equal(fileData, files[1].data) {
+		t.Errorf("ExtractFileTo extracted %q, %v; Want: %q", fileData, err, files[1].data)
+	}
+	err = zf.ExtractFileTo("missing.txt", "out/one")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("ExtractFileTo returned %v; Want: %v", err, ErrFileNotFound)
+	}
+}
+
+func TestExtractToFs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"dir/filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	archive, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+
+	// Read from a read-only file system, and write to another one
+	zf, err := OpenWithFs(zipFileName, afero.NewReadOnlyFs(fs))
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	dst := afero.NewMemMapFs()
+	err = zf.ExtractAllToFs(dst, "out")
+	if err != nil {
+		t.Fatalf("ExtractAllToFs returned error: %v", err)
+	}
+	for _, f := range files {
+		fileData, err := afero.ReadFile(dst, "out/"+f.name)
+		if err != nil {
+			t.Errorf("afero.ReadFile(%s) returned error: %v", f.name, err)
+		} else if !bytes.Equal(fileData, f.data) {
+			t.Errorf("Extracted %q; Want: %q", fileData, f.data)
+		}
+		exists, _ := afero.Exists(fs, "out/"+f.name)
+		if exists {
+			t.Errorf("ExtractAllToFs shouldn't extract %s to the archive's file system", f.name)
+		}
+	}
+
+	// A read-only archive can be extracted too
+	reader, err := OpenBytes(archive)
+	if err != nil {
+		t.Fatalf("OpenBytes returned error: %v", err)
+	}
+	err = reader.ExtractFileToFs(dst, files[1].name, "one")
+	if err != nil {
+		t.Fatalf("ExtractFileToFs returned error: %v", err)
+	}
+	fileData, err := afero.ReadFile(dst, "one/"+files[1].name)
+	if err != nil || !bytes.Equal(fileData, files[1].data) {
+		t.Errorf("ExtractFileToFs extracted %q, %v; Want: %q", fileData, err, files[1].data)
+	}
+	err = reader.ExtractFileToFs(dst, "missing.txt", "one")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("ExtractFileToFs returned %v; Want: %v", err, ErrFileNotFound)
+	}
+}
+
+func TestExtractAllWithOptions(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	small := []byte("A small file.")
+	bomb := bytes.Repeat([]byte{0}, 100000)
+	compressed, err := deflateData(context.Background(), bytes.NewReader(bomb), flate.BestCompression)
+	if err != nil {
+		t.Fatalf("deflateData returned error: %v", err)
+	}
+	makeCompressedZipFile(t, fs, zipFileName, "bomb.bin", COMPRESS_DEFLATED, bomb, compressed)
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	b := zf.Batch()
+	b.AddReader("a.txt", bytes.NewReader(small), COMPRESS_STORED)
+	b.AddReader("b.txt", bytes.NewReader(small), COMPRESS_STORED)
+	err = b.Commit()
+	if err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+
+	err = zf.ExtractAllWithOptions("out", ExtractOptions{MaxRatio: 100})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("ExtractAllWithOptions with MaxRatio returned %v; Want: %v", err, ErrTooLarge)
+	}
+	exists, _ := afero.Exists(fs, filepath.Join("out", "bomb.bin"))
+	if exists {
+		t.Error("ExtractAllWithOptions left behind a file that went over the limit")
+	}
+
+	err = zf.ExtractAllWithOptions("out", ExtractOptions{MaxTotalBytes: int64(len(bomb) + len(small))})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("ExtractAllWithOptions with MaxTotalBytes returned %v; Want: %v", err, ErrTooLarge)
+	}
+	exists, _ = afero.Exists(fs, filepath.Join("out", "b.txt"))
+	if exists {
+		t.Error("ExtractAllWithOptions extracted a file after going over MaxTotalBytes")
+	}
+
+	err = zf.ExtractAllWithOptions("all", ExtractOptions{MaxRatio: 1000, MaxTotalBytes: int64(len(bomb) + 2*len(small))})
+	if err != nil {
+		t.Errorf("ExtractAllWithOptions returned error: %v", err)
+	}
+}
+
+func TestExtractHugeLimits(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"file2.txt", "", bytes.Repeat([]byte("Second file in the archive. "), 100)},
+	}
+	makeZipFileWithMethod(t, fs, zipFileName, "", files, zip.Deflate)
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	// Limits this big can't be reached, so they mustn't overflow into small ones
+	for _, opts := range []ExtractOptions{
+		{MaxTotalBytes: math.MaxInt64},
+		{MaxRatio: math.MaxInt64},
+		{MaxRatio: math.MaxInt64 / 2, MaxTotalBytes: math.MaxInt64},
+	} {
+		err = zf.ExtractAllWithOptions("out", opts)
+		if err != nil {
+			t.Errorf("ExtractAllWithOptions with %+v returned error: %v", opts, err)
+		}
+	}
+}
+
+func TestExtractLimitLyingSize(t *testing.T) {
+	// The header says the file is small, but it decompresses to much more
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	bomb := bytes.Repeat([]byte{0}, 100000)
+	compressed, err := deflateData(context.Background(), bytes.NewReader(bomb), flate.BestCompression)
+	if err != nil {
+		t.Fatalf("deflateData returned error: %v", err)
+	}
+	makeCompressedZipFile(t, fs, zipFileName, "bomb.bin", COMPRESS_DEFLATED, bomb[:10], compressed)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.ExtractAllWithOptions("out", ExtractOptions{MaxRatio: 100})
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("ExtractAllWithOptions returned %v; Want: %v", err, ErrTooLarge)
+	}
+	exists, _ := afero.Exists(fs, filepath.Join("out", "bomb.bin"))
+	if exists {
+		t.Error("ExtractAllWithOptions left behind a file that went over the limit")
+	}
+}
+
+func TestExtractNoVerify(t *testing.T) {
+	// The stored data isn't the data the CRC was computed from
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	makeCompressedZipFile(t, fs, zipFileName, "bad.txt", COMPRESS_STORED, []byte("hello"), []byte("jello"))
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.ExtractAllWithOptions("verified", ExtractOptions{})
+	if err == nil {
+		t.Error("ExtractAllWithOptions didn't return an error for a CRC mismatch")
+	}
+	err = zf.ExtractAllWithOptions("out", ExtractOptions{NoVerify: true})
+	if err != nil {
+		t.Fatalf("ExtractAllWithOptions with NoVerify returned error: %v", err)
+	}
+	data, err := afero.ReadFile(fs, filepath.Join("out", "bad.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+	if string(data) != "jello" {
+		t.Errorf("Extracted data: %q; Want: %q", data, "jello")
+	}
+}
+
+func TestExtractAllDryRun(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"ok.txt", "", []byte("This file is fine.")},
+		{"dir/", "", []byte{}},
+		{"dir/ok.txt", "", []byte("So is this one.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.ExtractAllDryRun()
+	if err != nil {
+		t.Errorf("ExtractAllDryRun returned error: %v", err)
+	}
+	for _, f := range files {
+		exists, _ := afero.Exists(fs, f.name)
+		if exists {
+			t.Errorf("ExtractAllDryRun wrote %s", f.name)
+		}
+	}
+	zf.Close()
+
+	badFiles := []testfile{
+		{"../evil.txt", "", []byte("Outside the destination.")},
+		{"a.txt", "", []byte("A file...")},
+		{"a.txt/b.txt", "", []byte("...that's also a directory.")},
+		{"blocked/c.txt", "", []byte("A file on disk is in the way.")},
+		{"ok.txt", "", []byte("This file is fine.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", badFiles)
+	makeTestFile(fs, "blocked", []byte("Not a directory"))
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.ExtractAllDryRun()
+	if !errors.Is(err, ErrInsecurePath) {
+		t.Errorf("ExtractAllDryRun returned %v; Want: %v", err, ErrInsecurePath)
+	}
+	for _, name := range []string{"../evil.txt", "a.txt/b.txt", "blocked/c.txt"} {
+		if err == nil || !strings.Contains(err.Error(), "Extract "+name+":") {
+			t.Errorf("ExtractAllDryRun returned %v; Want an error for %s", err, name)
+		}
+	}
+	if strings.Contains(err.Error(), "Extract ok.txt:") {
+		t.Errorf("ExtractAllDryRun returned %v; Want no error for ok.txt", err)
+	}
+}
+
+func TestExtractToInsecurePath(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "dir/../../evil.txt", "/evil.txt"} {
+		fs := afero.NewMemMapFs()
+		zipFileName := "testArchive.zip"
+		files := []testfile{
+			{name, "", []byte("This file shouldn't be extracted.")},
+		}
+		makeZipFile(t, fs, zipFileName, "", files)
+
+		zf, err := OpenWithFs(zipFileName, fs)
+		if err != nil {
+			t.Fatalf("OpenWithFs returned error: %v", err)
+		}
+		err = zf.ExtractAllTo("out")
+		if !errors.Is(err, ErrInsecurePath) {
+			t.Errorf("ExtractAllTo(%s) returned %v; Want: %v", name, err, ErrInsecurePath)
+		}
+		err = zf.ExtractFileTo(name, "out")
+		if !errors.Is(err, ErrInsecurePath) {
+			t.Errorf("ExtractFileTo(%s) returned %v; Want: %v", name, err, ErrInsecurePath)
+		}
+		zf.Close()
+		for _, path := range []string{"evil.txt", "/evil.txt"} {
+			exists, _ := afero.Exists(fs, path)
+			if exists {
+				t.Errorf("%s was extracted outside the destination directory", name)
+			}
+		}
+	}
+}
+
+func TestExtractInsecurePath(t *testing.T) {
+	for _, name := range []string{"../evil.txt", "dir/../../evil.txt", "/evil.txt"} {
+		fs := afero.NewMemMapFs()
+		zipFileName := "testArchive.zip"
+		files := []testfile{
+			{name, "", []byte("This file shouldn't be extracted.")},
+		}
+		makeZipFile(t, fs, zipFileName, "", files)
+
+		zf, err := OpenWithFs(zipFileName, fs)
+		if err != nil {
+			t.Fatalf("OpenWithFs returned error: %v", err)
+		}
+		var testcases = []struct {
+			operation string
+			extract   func() error
+		}{
+			{"ExtractAll", zf.ExtractAll},
+			{"ExtractAllContinue", zf.ExtractAllContinue},
+			{"ExtractAllN", func() error { _, err := zf.ExtractAllN(); return err }},
+			{"ExtractAllWithProgress", func() error { return zf.ExtractAllWithProgress(func(string, int64, int64) {}) }},
+			{"ExtractFile", func() error { return zf.ExtractFile(name) }},
+			{"ExtractFileN", func() error { _, err := zf.ExtractFileN(name); return err }},
+			{"ExtractAllDryRun", zf.ExtractAllDryRun},
+		}
+		for _, c := range testcases {
+			err = c.extract()
+			if !errors.Is(err, ErrInsecurePath) {
+				t.Errorf("%s(%s) returned %v; Want: %v", c.operation, name, err, ErrInsecurePath)
+			}
+		}
+		zf.Close()
+		for _, path := range []string{"../evil.txt", "evil.txt", "/evil.txt"} {
+			exists, _ := afero.Exists(fs, path)
+			if exists {
+				t.Errorf("%s was extracted outside the working directory", name)
+			}
+		}
+	}
+}
+
+func TestDisplayComments(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "first comment", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	var output bytes.Buffer
+	zf.DisplayComments(&output)
+	if !strings.Contains(output.String(), files[0].name+"  "+files[0].comment+"\n") {
+		t.Errorf("DisplayComments output is missing the file comment:\n%s", output.String())
+	}
+	if !strings.Contains(output.String(), " "+files[1].name+"\n") {
+		t.Errorf("DisplayComments output is missing the file without a comment:\n%s", output.String())
+	}
+
+	output.Reset()
+	zf.Display(&output)
+	if strings.Contains(output.String(), files[0].comment) {
+		t.Errorf("Display output shouldn't have file comments:\n%s", output.String())
+	}
+}
+
+func TestSetArchiveComment(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "first comment", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+
+	makeZipFile(t, fs, zipFileName, "archive comment", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	if zf.Comment() != "archive comment" {
+		t.Errorf("Comment returned %q; Want: %q", zf.Comment(), "archive comment")
+	}
+	err = zf.SetArchiveComment("Built from commit abc123")
+	if err != nil {
+		t.Fatalf("SetArchiveComment returned error: %v", err)
+	}
+	err = zf.SetArchiveComment(strings.Repeat("x", 65536))
+	if err == nil {
+		t.Error("SetArchiveComment should fail for a comment longer than 65535 bytes")
+	}
+	err = zf.Save()
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "Built from commit abc123", files)
+
+	// Removing the comment
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.SetArchiveComment("")
+	if err != nil {
+		t.Fatalf("SetArchiveComment returned error: %v", err)
+	}
+	err = zf.Save()
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestCreateEmpty(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	verifyZipFile(t, fs, zipFileName, "", []testfile{})
+	if zf.NumEntries() != 0 {
+		t.Errorf("NumEntries returned %d; Want: 0", zf.NumEntries())
+	}
+	empty, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error for an empty archive: %v", err)
+	}
+	empty.Close()
+
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"filebeta.txt", "", []byte("Second file in the archive.")},
+	}
+	for _, f := range files {
+		err = zf.AddBytes(f.name, f.data, COMPRESS_STORED)
+		if err != nil {
+			t.Fatalf("AddBytes returned error: %v", err)
+		}
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestCreateArchive(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	fileData := bytes.Repeat([]byte("Deflated data. "), 100)
+	makeTestFile(fs, "file1.txt", fileData)
+
+	zf, err := CreateArchive(fs, zipFileName, CreateOptions{Method: COMPRESS_DEFLATED, Level: flate.BestCompression, Comment: "archive comment"})
+	if err != nil {
+		t.Fatalf("CreateArchive returned error: %v", err)
+	}
+	err = zf.AddFileDefault("file1.txt")
+	if err != nil {
+		t.Fatalf("AddFileDefault returned error: %v", err)
+	}
+	entry, _ := zf.GetEntry("file1.txt")
+	if entry.Method != COMPRESS_DEFLATED {
+		t.Errorf("AddFileDefault stored the file with %v; Want: %v", entry.Method, COMPRESS_DEFLATED)
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "archive comment", []testfile{{"file1.txt", "", fileData}})
+
+	// The zero Level compresses at the default level
+	zf, err = CreateArchive(fs, "default.zip", CreateOptions{Method: COMPRESS_DEFLATED})
+	if err != nil {
+		t.Fatalf("CreateArchive returned error: %v", err)
+	}
+	err = zf.AddFileDefault("file1.txt")
+	if err != nil {
+		t.Fatalf("AddFileDefault returned error: %v", err)
+	}
+	entry, _ = zf.GetEntry("file1.txt")
+	if entry.CompressedSize >= entry.UncompressedSize/10 {
+		t.Errorf("file1.txt was only compressed to %d bytes from %d", entry.CompressedSize, entry.UncompressedSize)
+	}
+	zf.Close()
+
+	var testcases = []struct {
+		name string
+		opts CreateOptions
+	}{
+		{"method", CreateOptions{Method: COMPRESS_BZIP2}},
+		{"level", CreateOptions{Method: COMPRESS_DEFLATED, Level: 10}},
+		{"comment", CreateOptions{Comment: strings.Repeat("x", 65536)}},
+	}
+	for _, c := range testcases {
+		_, err = CreateArchive(fs, "bad.zip", c.opts)
+		if err == nil {
+			t.Errorf("CreateArchive should return an error for a bad %s", c.name)
+		}
+	}
+	exists, _ := afero.Exists(fs, "bad.zip")
+	if exists {
+		t.Error("CreateArchive with bad options shouldn't make an archive")
+	}
+}
+
+func TestAddFileCleansName(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	fileData := []byte("This archive contains some text files.")
+	fs.MkdirAll("data", 0755)
+	makeTestFile(fs, filepath.Join("data", "x.txt"), fileData)
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	err = zf.AddFile("./data/x.txt", COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddFile returned error: %v", err)
+	}
+	b := zf.Batch()
+	for _, name := range []string{"a//b/../c.txt", "/abs.txt", "dir/"} {
+		err = b.AddReader(name, bytes.NewReader(nil), COMPRESS_STORED)
+		if err != nil {
+			t.Fatalf("AddReader(%q) returned error: %v", name, err)
+		}
+	}
+	err = b.Commit()
+	if err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+	expected := []string{"data/x.txt", "a/c.txt", "abs.txt", "dir/"}
+	if !slices.Equal(zf.Names(), expected) {
+		t.Errorf("Names returned %v; Want: %v", zf.Names(), expected)
+	}
+
+	for _, name := range []string{"../x.txt", "data/../../x.txt"} {
+		err = zf.AddBytes(name, fileData, COMPRESS_STORED)
+		if !errors.Is(err, ErrInsecurePath) {
+			t.Errorf("AddBytes(%q) returned %v; Want: %v", name, err, ErrInsecurePath)
+		}
+	}
+}
+
+func TestAddFileAs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	fileData := []byte("This archive contains some text files.")
+	sourcePath := filepath.Join("home", "me", "report.txt")
+	fs.MkdirAll(filepath.Dir(sourcePath), 0755)
+	makeTestFile(fs, sourcePath, fileData)
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	err = zf.AddFileAs(sourcePath, filepath.Base(sourcePath), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddFileAs returned error: %v", err)
+	}
+	err = zf.AddFileAs(sourcePath, "docs/copy.txt", COMPRESS_DEFLATED)
+	if err != nil {
+		t.Fatalf("AddFileAs returned error: %v", err)
+	}
+	err = zf.AddFileAs("missing.txt", "missing.txt", COMPRESS_STORED)
+	if err == nil {
+		t.Error("AddFileAs should return an error for a file that doesn't exist")
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "", []testfile{{"report.txt", "", fileData}, {"docs/copy.txt", "", fileData}})
+}
+
+func TestAddFileStrict(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+	makeTestFile(fs, "file1.txt", []byte("A different file with the same name."))
+	newFile := testfile{"file2.txt", "", []byte("Second file in the archive.")}
+	makeTestFile(fs, newFile.name, newFile.data)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	err = zf.AddFileStrict("file1.txt", COMPRESS_STORED)
+	if !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("AddFileStrict returned %v; Want: %v", err, ErrDuplicateName)
+	}
+	err = zf.AddFileStrict(newFile.name, COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddFileStrict returned error: %v", err)
+	}
+
+	// A batch can't add the same name twice either
+	b := zf.Batch()
+	err = b.AddReader("queued.txt", bytes.NewReader(newFile.data), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddReader returned error: %v", err)
+	}
+	err = b.AddFileStrict(newFile.name, COMPRESS_STORED)
+	if !errors.Is(err, ErrDuplicateName) {
+		t.Errorf("Batch.AddFileStrict returned %v; Want: %v", err, ErrDuplicateName)
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "", append(files, newFile))
+}
+
+func TestAddFileUnixMode(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"script.sh", "", []byte("#!/bin/sh\necho hello\n")},
+		{"readonly.txt", "", []byte("This file can't be changed.")},
+	}
+	modes := []os.FileMode{0755, 0444}
+	for i, f := range files {
+		makeTestFile(fs, f.name, f.data)
+		fs.Chmod(f.name, modes[i])
+	}
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	for _, f := range files {
+		err = zf.AddFile(f.name, COMPRESS_STORED)
+		if err != nil {
+			t.Fatalf("AddFile returned error: %v", err)
+		}
+	}
+
+	archiveData, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archiveData), int64(len(archiveData)))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	for i, f := range r.File {
+		if f.Mode() != modes[i] {
+			t.Errorf("%s has mode %v; Want: %v", f.Name, f.Mode(), modes[i])
+		}
+	}
+
+	err = zf.ExtractAllTo("out")
+	if err != nil {
+		t.Fatalf("ExtractAllTo returned error: %v", err)
+	}
+	for i, f := range files {
+		info, err := fs.Stat(filepath.Join("out", f.name))
+		if err != nil {
+			t.Fatalf("fs.Stat returned error: %v", err)
+		}
+		if info.Mode().Perm() != modes[i] {
+			t.Errorf("Extracted %s has mode %v; Want: %v", f.name, info.Mode().Perm(), modes[i])
+		}
+	}
+}
+
+func TestTextAttribute(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"text.txt", "", []byte("Some text,\r\n\twith whitespace.\n")},
+		{"binary.bin", "", []byte("\x89PNG\r\n\x1a\n\x00\x00")},
+		{"empty.txt", "", []byte{}},
+	}
+	makeTestFile(fs, files[0].name, files[0].data)
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	err = zf.AddFile(files[0].name, COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddFile returned error: %v", err)
+	}
+	for _, f := range files[1:] {
+		err = zf.AddBytes(f.name, f.data, COMPRESS_STORED)
+		if err != nil {
+			t.Fatalf("AddBytes returned error: %v", err)
+		}
+	}
+	zf.Close()
+
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	expected := []uint16{INTERNAL_ATTR_TEXT, 0, 0}
+	for i, fh := range zf.fileHeaders {
+		if fh.internalAttr != expected[i] {
+			t.Errorf("%s has internal attributes %#x; Want: %#x", fh.fileName, fh.internalAttr, expected[i])
+		}
+	}
+}
+
+func TestAddFileWithTime(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	fileToAdd := testfile{"file1.txt", "", []byte("This archive contains some text files.")}
+	makeTestFile(fs, fileToAdd.name, fileToAdd.data)
+	modTime := time.Date(2020, time.January, 2, 10, 20, 0, 0, time.Local)
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	err = zf.AddFileWithTime(fileToAdd.name, COMPRESS_STORED, modTime)
+	if err != nil {
+		t.Fatalf("AddFileWithTime returned error: %v", err)
+	}
+	entries := zf.List()
+	if len(entries) != 1 || !entries[0].Modified.Equal(modTime) {
+		t.Errorf("List returned %v; Want a file modified at %v", entries, modTime)
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	verifyZipFile(t, fs, zipFileName, "", []testfile{fileToAdd})
+
+	archiveData, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archiveData), int64(len(archiveData)))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	if !r.File[0].Modified.Equal(modTime) {
+		t.Errorf("File was stored with modification time %v; Want: %v", r.File[0].Modified, modTime)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"copy1.txt", "", []byte("This archive contains some text files.")},
+		{"other.txt", "", []byte("A file with different contents.")},
+		{"dir/copy2.txt", "", []byte("This archive contains some text files.")},
+		{"other copy.txt", "", []byte("A file with different contents.")},
+		{"empty1.txt", "", []byte{}},
+		{"empty2.txt", "", []byte{}},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	groups, err := zf.FindDuplicates()
+	if err != nil {
+		t.Fatalf("FindDuplicates returned error: %v", err)
+	}
+	expected := [][]string{{"file1.txt", "copy1.txt", "dir/copy2.txt"}, {"other.txt", "other copy.txt"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("FindDuplicates returned %v; Want: %v", groups, expected)
+	}
+
+	removed, err := zf.Deduplicate()
+	if err != nil {
+		t.Fatalf("Deduplicate returned error: %v", err)
+	}
+	if removed != 3 {
+		t.Errorf("Deduplicate returned %d; Want: 3", removed)
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "", []testfile{files[0], files[2], files[5], files[6]})
+}
+
+func TestDeduplicateSameName(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	// The duplicate has the same name as an earlier file with different contents,
+	// which has to be kept
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+		{"file2.txt", "", []byte("A file with different contents.")},
+		{"file1.txt", "", []byte("A file with different contents.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	removed, err := zf.Deduplicate()
+	if err != nil {
+		t.Fatalf("Deduplicate returned error: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Deduplicate returned %d; Want: 1", removed)
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "", files[:2])
+}
+
+func TestOptimize(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "First comment", bytes.Repeat([]byte("This archive contains some text files. "), 100)},
+		{"dir/", "", []byte{}},
+		{"dir/filebeta.txt", "", bytes.Repeat([]byte("Second file in the archive. "), 100)},
+	}
+	makeZipFile(t, fs, zipFileName, "Archive comment", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	before := zf.List()
+	err = zf.Optimize(COMPRESS_DEFLATED)
+	if err != nil {
+		t.Fatalf("Optimize returned error: %v", err)
+	}
+	after := zf.List()
+	for i, e := range after {
+		if e.Name != before[i].Name || e.Comment != before[i].Comment || !e.Modified.Equal(before[i].Modified) {
+			t.Errorf("Optimize changed %v to %v", before[i], e)
+		}
+		if e.Name == "dir/" {
+			if e.Method != COMPRESS_STORED {
+				t.Errorf("Directory has method %d; Want: %d", e.Method, COMPRESS_STORED)
+			}
+		} else if e.Method != COMPRESS_DEFLATED || e.CompressedSize >= e.UncompressedSize {
+			t.Errorf("%s has method %d and compressed size %d; Want: deflated and smaller than %d", e.Name, e.Method, e.CompressedSize, e.UncompressedSize)
+		}
+	}
+	zf.Close()
+	verifyZipFile(t, fs, zipFileName, "Archive comment", files)
+}
+
+func TestAddFileDeflated(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"fast.txt", "", bytes.Repeat([]byte("This file is deflated quickly. "), 100)},
+		{"best.txt", "", bytes.Repeat([]byte("This file is deflated as much as possible. "), 100)},
+		{"none.txt", "", bytes.Repeat([]byte("This file is deflated without compression. "), 100)},
+		{"default.txt", "", bytes.Repeat([]byte("This file is deflated with the zero level. "), 100)},
+	}
+	levels := []int{flate.BestSpeed, flate.BestCompression, LEVEL_NO_COMPRESSION, 0}
+	for _, f := range files {
+		makeTestFile(fs, f.name, f.data)
+	}
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	for i, f := range files {
+		err = zf.AddFileWithOptions(f.name, AddOptions{Method: COMPRESS_DEFLATED, Level: levels[i]})
+		if err != nil {
+			t.Fatalf("AddFileWithOptions returned error: %v", err)
+		}
+	}
+	err = zf.AddFileWithOptions(files[0].name, AddOptions{Method: COMPRESS_DEFLATED, Level: 10})
+	if err == nil {
+		t.Error("AddFileWithOptions should return an error for an invalid level")
+	}
+
+	entries := zf.List()
+	for i, e := range entries {
+		if e.Method != COMPRESS_DEFLATED {
+			t.Errorf("%s has method %d; Want: %d", e.Name, e.Method, COMPRESS_DEFLATED)
+		}
+		if levels[i] == LEVEL_NO_COMPRESSION && e.CompressedSize <= e.UncompressedSize {
+			t.Errorf("%s was compressed to %d bytes with LEVEL_NO_COMPRESSION", e.Name, e.CompressedSize)
+		} else if levels[i] != LEVEL_NO_COMPRESSION && e.CompressedSize >= e.UncompressedSize/10 {
+			t.Errorf("%s was only compressed to %d bytes from %d", e.Name, e.CompressedSize, e.UncompressedSize)
+		}
+	}
+	for _, f := range files {
+		data, err := zf.ReadFile(f.name)
+		if err != nil {
+			t.Fatalf("ReadFile returned error: %v", err)
+		}
+		if !bytes.Equal(data, f.data) {
+			t.Errorf("ReadFile returned %q; Want: %q", data, f.data)
+		}
+	}
+	err = zf.Close()
+	if err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	verifyZipFile(t, fs, zipFileName, "", files)
+}
+
+func TestSetLocation(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	fileToAdd := testfile{"file1.txt", "", []byte("This archive contains some text files.")}
+	makeTestFile(fs, fileToAdd.name, fileToAdd.data)
+	east := time.FixedZone("UTC+5", 5*60*60)
+	modTime := time.Date(2020, time.January, 2, 10, 20, 0, 0, east)
+
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	zf.SetLocation(time.UTC)
+	err = zf.AddFileWithTime(fileToAdd.name, COMPRESS_STORED, modTime)
+	if err != nil {
+		t.Fatalf("AddFileWithTime returned error: %v", err)
+	}
+	err = zf.AddBytes("file2.txt", []byte("Second file in the archive."), COMPRESS_STORED)
+	if err != nil {
+		t.Fatalf("AddBytes returned error: %v", err)
+	}
+	entries := zf.List()
+	if !entries[0].Modified.Equal(modTime) || entries[0].Modified.Location() != time.UTC {
+		t.Errorf("List returned modification time %v; Want: %v", entries[0].Modified, modTime.UTC())
+	}
+	if time.Since(entries[1].Modified).Abs() > time.Minute {
+		t.Errorf("List returned modification time %v for a new file; Want about %v", entries[1].Modified, time.Now().UTC())
+	}
+	zf.Close()
+
+	// The DOS time is written in UTC
+	archiveData, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archiveData), int64(len(archiveData)))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	// archive/zip reads DOS times as UTC when there's no extended timestamp
+	if !r.File[0].Modified.Equal(modTime) {
+		t.Errorf("File was stored with modification time %v; Want: %v", r.File[0].Modified, modTime.UTC())
+	}
+
+	// Reading it in another time zone gives another time
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	zf.SetLocation(east)
+	if got := zf.List()[0].Modified; !got.Equal(modTime.Add(-5 * time.Hour)) {
+		t.Errorf("List returned modification time %v; Want: %v", got, modTime.Add(-5*time.Hour))
+	}
+}
+
+func TestDosTimeSeconds(t *testing.T) {
+	for _, sec := range []int{0, 1, 30, 58, 59} {
+		modTime := time.Date(2020, time.January, 2, 10, 20, sec, 0, time.UTC)
+		dosDate, dosTime := timeToDosDateTime(modTime)
+		want := modTime.Truncate(2 * time.Second)
+		if got := dosToTime(dosDate, dosTime, time.UTC); !got.Equal(want) {
+			t.Errorf("DOS time for %v reads back as %v; Want: %v", modTime, got, want)
+		}
+	}
+
+	// Check against another zip reader
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	fileToAdd := testfile{"file1.txt", "", []byte("This archive contains some text files.")}
+	makeTestFile(fs, fileToAdd.name, fileToAdd.data)
+	modTime := time.Date(2020, time.January, 2, 10, 20, 59, 0, time.UTC)
+	zf, err := CreateEmptyWithFs(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("CreateEmptyWithFs returned error: %v", err)
+	}
+	zf.SetLocation(time.UTC)
+	err = zf.AddFileWithTime(fileToAdd.name, COMPRESS_STORED, modTime)
+	if err != nil {
+		t.Fatalf("AddFileWithTime returned error: %v", err)
+	}
+	zf.Close()
+	archiveData, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archiveData), int64(len(archiveData)))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	if want := modTime.Add(-time.Second); !r.File[0].Modified.Equal(want) {
+		t.Errorf("File was stored with modification time %v; Want: %v", r.File[0].Modified, want)
+	}
+}
+
+func TestExtendedTimestamp(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	modTime := time.Date(2020, time.January, 2, 10, 20, 59, 0, time.UTC)
+
+	// The other zip writer adds an extended timestamp for the modification time
+	zipFile, err := fs.Create(zipFileName)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "file1.txt", Method: zip.Store, Modified: modTime})
+	if err != nil {
+		t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+	}
+	writer.Write([]byte("This archive contains some text files."))
+	zipWriter.Close()
+	zipFile.Close()
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	if got := zf.List()[0].Modified; !got.Equal(modTime) {
+		t.Errorf("List returned modification time %v; Want: %v", got, modTime)
+	}
+	err = zf.ExtractFile("file1.txt")
+	if err != nil {
+		t.Fatalf("ExtractFile returned error: %v", err)
+	}
+	info, err := fs.Stat("file1.txt")
+	if err != nil {
+		t.Fatalf("fs.Stat returned error: %v", err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("Extracted file has modification time %v; Want: %v", info.ModTime(), modTime)
+	}
+
+	// The timestamp is kept when the archive is rewritten
+	err = zf.Save()
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if got := zf.List()[0].Modified; !got.Equal(modTime) {
+		t.Errorf("After Save, List returned modification time %v; Want: %v", got, modTime)
+	}
+	zf.Close()
+	archiveData, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(archiveData), int64(len(archiveData)))
+	if err != nil {
+		t.Fatalf("zip.NewReader returned error: %v", err)
+	}
+	if !r.File[0].Modified.Equal(modTime) {
+		t.Errorf("After Save, file has modification time %v; Want: %v", r.File[0].Modified, modTime)
+	}
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error after Save: %v", err)
+	}
+	defer zf.Close()
+	fileData, err := zf.ReadFile("file1.txt")
+	if err != nil || string(fileData) != "This archive contains some text files." {
+		t.Errorf("ReadFile returned %q, %v after Save", fileData, err)
+	}
+}
+
+func TestUnixOwner(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	newField := []byte("\x75\x78\x0b\x00\x01\x04\xe8\x03\x00\x00\x04\x64\x00\x00\x00")     // UID 1000, GID 100
+	oldField := []byte("\x55\x58\x0c\x00\x00\x00\x00\x00\x00\x00\x00\x00\xf5\x01\xf6\x01") // UID 501, GID 502
+
+	// The old field's central version only has the times, so it's padded with an empty
+	// field to the same length as the local one and swapped in below
+	oldCentralField := []byte("\x55\x58\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\xfe\xca\x00\x00")
+
+	zipFile, err := fs.Create(zipFileName)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	for _, f := range []struct {
+		name  string
+		extra []byte
+	}{{"new.txt", newField}, {"old.txt", oldField}, {"none.txt", nil}} {
+		header := zip.FileHeader{Name: f.name, Method: zip.Store, Extra: f.extra}
+		header.SetMode(0750)
+		writer, err := zipWriter.CreateHeader(&header)
+		if err != nil {
+			t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+		}
+		writer.Write([]byte("File owned by someone."))
+	}
+	zipWriter.Close()
+	zipFile.Close()
+	data, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+	copy(data[bytes.LastIndex(data, oldField):], oldCentralField)
+	err = afero.WriteFile(fs, zipFileName, data, 0644)
+	if err != nil {
+		t.Fatalf("afero.WriteFile returned error: %v", err)
+	}
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	expOwners := [][2]int{{1000, 100}, {501, 502}, {-1, -1}}
+	for i, e := range zf.List() {
+		if e.UID != expOwners[i][0] || e.GID != expOwners[i][1] {
+			t.Errorf("%s has owner %d:%d; Want: %d:%d", e.Name, e.UID, e.GID, expOwners[i][0], expOwners[i][1])
+		}
+		if e.Mode != 0750 {
+			t.Errorf("%s has mode %v; Want: %v", e.Name, e.Mode, os.FileMode(0750))
+		}
+	}
+
+	zf.SetRestoreOwner(true)
+	err = zf.ExtractAll()
+	if err != nil {
+		t.Fatalf("ExtractAll returned error: %v", err)
+	}
+
+	// The new Unix field is kept when the archive is rewritten
+	err = zf.Save()
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	e := zf.List()[0]
+	if e.UID != 1000 || e.GID != 100 {
+		t.Errorf("After Save, %s has owner %d:%d; Want: 1000:100", e.Name, e.UID, e.GID)
+	}
+
+	// The old field's owner is kept as a new field, so it's still there when the
+	// archive is reopened
+	zf.Close()
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error after Save: %v", err)
+	}
+	defer zf.Close()
+	for i, e := range zf.List() {
+		if e.UID != expOwners[i][0] || e.GID != expOwners[i][1] {
+			t.Errorf("After Save, %s has owner %d:%d; Want: %d:%d", e.Name, e.UID, e.GID, expOwners[i][0], expOwners[i][1])
+		}
+	}
+}
+
+func TestExtractSymlink(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	zipFile, err := fs.Create(zipFileName)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	for _, f := range []struct {
+		name string
+		mode os.FileMode
+		data string
+	}{
+		{"dir/file1.txt", 0644, "This archive contains some text files."},
+		{"dir/link.txt", os.ModeSymlink | 0777, "file1.txt"},
+		{"uplink.txt", os.ModeSymlink | 0777, "dir/file1.txt"},
+		{"evil.txt", os.ModeSymlink | 0777, "../outside.txt"},
+	} {
+		header := zip.FileHeader{Name: f.name, Method: zip.Store}
+		header.SetMode(f.mode)
+		writer, err := zipWriter.CreateHeader(&header)
+		if err != nil {
+			t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+		}
+		writer.Write([]byte(f.data))
+	}
+	zipWriter.Close()
+	zipFile.Close()
+	archiveData, err := afero.ReadFile(fs, zipFileName)
+	if err != nil {
+		t.Fatalf("afero.ReadFile returned error: %v", err)
+	}
+
+	zf, err := OpenBytes(archiveData)
+	if err != nil {
+		t.Fatalf("OpenBytes returned error: %v", err)
+	}
+	if mode := zf.List()[1].Mode; mode != os.ModeSymlink|0777 {
+		t.Errorf("Symlink has mode %v; Want: %v", mode, os.ModeSymlink|0777)
+	}
+
+	// Symlinks need a file system that supports them
+	dir := t.TempDir()
+	osFs := afero.NewOsFs()
+	err = makeTestFile(osFs, filepath.Join(dir, zipFileName), archiveData)
+	if err != nil {
+		t.Fatalf("makeTestFile returned error: %v", err)
+	}
+	zf, err = OpenWithFs(filepath.Join(dir, zipFileName), osFs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	out := filepath.Join(dir, "out")
+	for _, name := range []string{"dir/file1.txt", "dir/link.txt", "uplink.txt"} {
+		err = zf.ExtractFileTo(name, out)
+		if err != nil {
+			t.Fatalf("ExtractFileTo(%s) returned error: %v", name, err)
+		}
+	}
+	for link, target := range map[string]string{"dir/link.txt": "file1.txt", "uplink.txt": "dir/file1.txt"} {
+		got, err := os.Readlink(filepath.Join(out, link))
+		if err != nil {
+			t.Errorf("os.Readlink(%s) returned error: %v", link, err)
+		} else if got != target {
+			t.Errorf("%s links to %q; Want: %q", link, got, target)
+		}
+	}
+	fileData, err := os.ReadFile(filepath.Join(out, "dir/link.txt"))
+	if err != nil || string(fileData) != "This archive contains some text files." {
+		t.Errorf("Reading through the symlink returned %q, %v", fileData, err)
+	}
+
+	err = zf.ExtractFileTo("evil.txt", out)
+	if !errors.Is(err, ErrInsecurePath) {
+		t.Errorf("ExtractFileTo returned %v for a symlink out of the directory; Want: %v", err, ErrInsecurePath)
+	}
+	_, err = os.Lstat(filepath.Join(out, "evil.txt"))
+	if err == nil {
+		t.Error("A symlink out of the directory was extracted")
+	}
+}
+
+func TestEncryptedEntries(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	files := []testfile{
+		{"file1.txt", "", []byte("This archive contains some text files.")},
+	}
+	makeZipFile(t, fs, zipFileName, "", files)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	if zf.HasEncryptedEntries() || zf.List()[0].IsEncrypted() {
+		t.Error("An archive without encryption shouldn't be marked encrypted")
+	}
+	zf.Close()
+
+	// Mark the file as encrypted in both of its headers
+	zipFile, err := fs.Create(zipFileName)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	zipWriter := zip.NewWriter(zipFile)
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "secret.txt", Method: zip.Store, Flags: 0x1})
+	if err != nil {
+		t.Fatalf("zipWriter.CreateHeader returned error: %v", err)
+	}
+	writer.Write([]byte("\x8f\x03\x1c\xe2ciphertext"))
+	zipWriter.Close()
+	zipFile.Close()
+
+	zf, err = OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+	if !zf.HasEncryptedEntries() || !zf.List()[0].IsEncrypted() {
+		t.Error("An encrypted file should be marked encrypted")
+	}
+	err = zf.ExtractFile("secret.txt")
+	if !errors.Is(err, ErrEncrypted) {
+		t.Errorf("ExtractFile returned %v; Want: %v", err, ErrEncrypted)
+	}
+	exists, _ := afero.Exists(fs, "secret.txt")
+	if exists {
+		t.Error("ExtractFile shouldn't write an encrypted file")
+	}
+	_, err = zf.ReadFile("secret.txt")
+	if !errors.Is(err, ErrEncrypted) {
+		t.Errorf("ReadFile returned %v; Want: %v", err, ErrEncrypted)
+	}
+}
+
+// aesPayload is "This file is encrypted with WinZip AES-256." (stored) encrypted as an
+// AE-2 file with the password "secret": the salt, password verifier, encrypted data,
+// and authentication code.
+const aesPayload = "\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x6b\xb8" +
+	"\x17\xf9\x02\x13\x18\x6f\x5d\xba\x71\xd7\xae\x62\xf8\xc2\xff\xae\xcd\xb5\x4d\xa7" +
+	"\x1e\x2f\xa8\xcd\x49\x23\xc6\x81\x08\xc5\xad\x60\x31\x4f\x3a\xe5\xfd\xb2\xdc\xa9" +
+	"\x47\x55\x75\xda\x49\x79\x8c\xc6\xda\xb2\x6c\xe7\xa0"
+
+func makeAESZipFile(t *testing.T, fs afero.Fs, zipname string, payload string) {
+	zipFile, err := fs.Create(zipname)
+	if err != nil {
+		t.Fatalf("fs.Create returned error: %v", err)
+	}
+	defer zipFile.Close()
+
+	zipWriter := zip.NewWriter(zipFile)
+	defer zipWriter.Close()
+
+	header := zip.FileHeader{
+		Name:               "secret.txt",
+		Modified:           time.Now(),
+		Method:             COMPRESS_AES,
+		Flags:              FLAG_ENCRYPTED,
+		Extra:              []byte("\x01\x99\x07\x00\x02\x00AE\x03\x00\x00"), // AE-2, AES-256, stored
+		CompressedSize64:   uint64(len(payload)),
+		UncompressedSize64: 43,
+	}
+	writer, err := zipWriter.CreateRaw(&header)
+	if err != nil {
+		t.Fatalf("zipWriter.CreateRaw returned error: %v", err)
+	}
+	_, err = writer.Write([]byte(payload))
+	if err != nil {
+		t.Fatalf("writer.Write returned error: %v", err)
+	}
+}
+
+func TestExtractAES(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	zipFileName := "testArchive.zip"
+	makeAESZipFile(t, fs, zipFileName, aesPayload)
+
+	zf, err := OpenWithFs(zipFileName, fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf.Close()
+
+	_, err = zf.ReadFile("secret.txt")
+	if !errors.Is(err, ErrEncrypted) {
+		t.Errorf("ReadFile without a password returned %v; Want: %v", err, ErrEncrypted)
+	}
+	zf.SetPassword("wrong")
+	_, err = zf.ReadFile("secret.txt")
+	if !errors.Is(err, ErrBadPassword) {
+		t.Errorf("ReadFile with the wrong password returned %v; Want: %v", err, ErrBadPassword)
+	}
+
+	zf.SetPassword("secret")
+	expected := "This file is encrypted with WinZip AES-256."
+	data, err := zf.ReadFile("secret.txt")
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+	if string(data) != expected {
+		t.Errorf("ReadFile returned %q; Want: %q", data, expected)
+	}
+	err = zf.ExtractFile("secret.txt")
+	if err != nil {
+		t.Fatalf("ExtractFile returned error: %v", err)
+	}
+	extracted, _ := afero.ReadFile(fs, "secret.txt")
+	if string(extracted) != expected {
+		t.Errorf("Extracted file has %q; Want: %q", extracted, expected)
+	}
+	err = zf.VerifyAll()
+	if err != nil {
+		t.Errorf("VerifyAll returned error: %v", err)
+	}
+
+	// Corrupt the authentication code
+	corrupt := aesPayload[:len(aesPayload)-1] + "\x00"
+	makeAESZipFile(t, fs, "corrupt.zip", corrupt)
+	zf2, err := OpenWithFs("corrupt.zip", fs)
+	if err != nil {
+		t.Fatalf("OpenWithFs returned error: %v", err)
+	}
+	defer zf2.Close()
+	zf2.SetPassword("secret")
+	_, err = zf2.ReadFile("secret.txt")
+	if err == nil {
+		t.Error("ReadFile should fail when the authentication code doesn't match")
+	}
+}
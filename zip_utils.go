@@ -1,14 +1,26 @@
 package zip
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/afero"
+	"golang.org/x/text/encoding/charmap"
 )
 
 // CompressionMethod is a uint16 corresponding to the compression method field
@@ -18,6 +30,9 @@ type CompressionMethod uint16
 const (
 	COMPRESS_STORED   = 0
 	COMPRESS_DEFLATED = 8
+	COMPRESS_BZIP2    = 12
+	COMPRESS_ZSTD     = 93
+	COMPRESS_AES      = 99 // WinZip AES encryption; the real method is in the AES extra field
 )
 
 func compressionMethodToString(method CompressionMethod) string {
@@ -26,23 +41,272 @@ func compressionMethodToString(method CompressionMethod) string {
 		return "stored"
 	case COMPRESS_DEFLATED:
 		return "deflated"
+	case COMPRESS_BZIP2:
+		return "bzip2"
+	case COMPRESS_ZSTD:
+		return "zstd"
+	case 1:
+		return "shrunk"
+	case 6:
+		return "imploded"
+	case 9:
+		return "deflate64"
+	case 14:
+		return "LZMA"
+	case 95:
+		return "xz"
+	case 98:
+		return "PPMd"
+	case COMPRESS_AES:
+		return "AES"
 	default:
 		return fmt.Sprintf("%d", method)
 	}
 }
 
+// unsupportedMethodError returns the error for reading a file whose compression method
+// we can't decompress.
+func unsupportedMethodError(fh *fileHeader, method CompressionMethod) error {
+	name := compressionMethodToString(method)
+	if name == fmt.Sprintf("%d", method) {
+		return fmt.Errorf("%w %d for entry %q", ErrUnsupportedMethod, method, fh.fileName)
+	}
+	return fmt.Errorf("%w %d (%s) for entry %q", ErrUnsupportedMethod, method, name, fh.fileName)
+}
+
+// ConflictPolicy says what to do when a file being copied into an archive has the same
+// name as a file that's already there.
+type ConflictPolicy int
+
+const (
+	CONFLICT_SKIP      = 0 // keep the file that's already in the archive
+	CONFLICT_OVERWRITE = 1 // replace it with the file being copied
+	CONFLICT_ERROR     = 2 // return ErrDuplicateName without changing the archive
+)
+
+// CommentPolicy says what comment an archive gets when another archive is merged into
+// it.
+type CommentPolicy int
+
+const (
+	COMMENT_EMPTY  = 0 // no comment
+	COMMENT_FIRST  = 1 // keep the archive's own comment
+	COMMENT_CONCAT = 2 // the archive's comment and then the other's, on separate lines
+	COMMENT_CUSTOM = 3 // MergeOptions.Comment
+)
+
+// MergeOptions are options for merging another archive into an archive. The zero
+// MergeOptions skips conflicting files and leaves the archive without a comment.
+type MergeOptions struct {
+	OnConflict    ConflictPolicy // what to do with files whose names are already in the archive
+	CommentPolicy CommentPolicy  // what the archive's comment is after the merge
+	Comment       string         // the comment for COMMENT_CUSTOM
+}
+
+// mergedComment returns the archive comment for merging other into zf with opts.
+func (opts MergeOptions) mergedComment(zf *File, other *File) (string, error) {
+	switch opts.CommentPolicy {
+	case COMMENT_EMPTY:
+		return "", nil
+	case COMMENT_FIRST:
+		return zf.Comment(), nil
+	case COMMENT_CONCAT:
+		comments := []string{}
+		for _, comment := range []string{zf.Comment(), other.Comment()} {
+			if comment != "" {
+				comments = append(comments, comment)
+			}
+		}
+		return strings.Join(comments, "\n"), nil
+	case COMMENT_CUSTOM:
+		return opts.Comment, nil
+	default:
+		return "", fmt.Errorf("unknown comment policy %d", opts.CommentPolicy)
+	}
+}
+
+// LEVEL_NO_COMPRESSION is the AddOptions and CreateOptions Level for deflating without
+// compressing. flate.NoCompression can't be used for that, since it's 0, and a Level of
+// 0 means flate.DefaultCompression.
+const LEVEL_NO_COMPRESSION = flate.HuffmanOnly - 1
+
+// AddOptions are options for adding a file to the archive. Level is a compress/flate
+// level, except that 0 (which is flate.NoCompression) means flate.DefaultCompression,
+// so that the zero AddOptions compresses; use LEVEL_NO_COMPRESSION instead of
+// flate.NoCompression.
+type AddOptions struct {
+	Method CompressionMethod // compression method to store the file with
+	Level  int               // for COMPRESS_DEFLATED, the level; 0 is flate.DefaultCompression, not flate.NoCompression
+}
+
+// flateLevel returns the compress/flate level for opts.Level.
+func (opts AddOptions) flateLevel() int {
+	switch opts.Level {
+	case 0:
+		return flate.DefaultCompression
+	case LEVEL_NO_COMPRESSION:
+		return flate.NoCompression
+	default:
+		return opts.Level
+	}
+}
+
+// ExtractOptions are options for extracting files. The limits are for archives that
+// can't be trusted, like zip bombs that decompress to far more data than they take up.
+// Zero means no limit.
+type ExtractOptions struct {
+	MaxRatio      int64 // the most times larger than its compressed data a file can be
+	MaxTotalBytes int64 // the most bytes that can be extracted from the whole archive
+	NoVerify      bool  // skip checking CRCs, for speed with archives that are known to be good
+}
+
+// CreateOptions are options for a new archive from CreateArchive. Level is like
+// AddOptions.Level: 0 means flate.DefaultCompression, and LEVEL_NO_COMPRESSION is used
+// instead of flate.NoCompression.
+type CreateOptions struct {
+	Method  CompressionMethod // compression method for files added with AddFileDefault
+	Level   int               // for COMPRESS_DEFLATED, the level for AddFileDefault; 0 is flate.DefaultCompression
+	Comment string            // the archive's comment
+}
+
+// checkLevel returns an error if level isn't a compress/flate level or
+// LEVEL_NO_COMPRESSION. operation is used for the error.
+func checkLevel(operation string, level int) error {
+	if level < LEVEL_NO_COMPRESSION || level > flate.BestCompression {
+		return newZipErrorStr(operation, fmt.Sprintf("invalid compression level %d", level))
+	}
+	return nil
+}
+
+// checkWriteMethod returns an error if we can't write files with the given
+// compression method. operation is used for the error.
+func checkWriteMethod(operation string, method CompressionMethod) error {
+	switch method {
+	case COMPRESS_STORED, COMPRESS_DEFLATED:
+		return nil
+	default:
+		return newZipErrorStr(operation, fmt.Sprintf("can't write files with compression method %s", compressionMethodToString(method)))
+	}
+}
+
 const (
 	// If we have no files, then we only have end-of-central-dir record
 	CENTRAL_DIR_MIN_SIZE = 22
 
+	// The end-of-central-dir record is followed by a comment of at most 65535 bytes,
+	// so it can't start any further than this from the end of the file
+	EOCD_MAX_SEARCH = CENTRAL_DIR_MIN_SIZE + math.MaxUint16
+
 	// Constants for file headers that we make from scratch
 	VERSION_MADE_BY = 20
 	VERSION_NEEDED  = 20
 	FLAGS           = 0
 	INTERNAL_ATTR   = 0
 	EXTERNAL_ATTR   = 0
+
+	// General purpose flag: the file's data is encrypted
+	FLAG_ENCRYPTED = 0x1
+
+	// General purpose flag bits that say which deflate option the file was compressed
+	// with, which are meaningless for other methods
+	FLAG_DEFLATE_OPTIONS = 0x6
+
+	// General purpose flag: CRC and sizes are in a data descriptor after the file data
+	FLAG_DATA_DESCRIPTOR = 0x8
+
+	// General purpose flag: file name and comment are UTF-8 rather than CP437
+	FLAG_UTF8 = 0x800
+
+	// Internal attribute: the file is text (rather than binary) data
+	INTERNAL_ATTR_TEXT = 0x1
+
+	// MS-DOS directory attribute, for directory entries that we make from scratch
+	EXTERNAL_ATTR_DIR = 0x10
+
+	// MS-DOS read-only attribute
+	EXTERNAL_ATTR_READONLY = 0x01
+
+	// Host system in the upper byte of "version made by" whose external attributes
+	// have the Unix mode in their upper 16 bits
+	HOST_UNIX = 3
+
+	// File type bits of the Unix mode, and the types for regular files, directories,
+	// and symlinks
+	S_IFMT  = 0170000
+	S_IFREG = 0100000
+	S_IFDIR = 0040000
+	S_IFLNK = 0120000
+
+	// Permissions for extracted files when the archive doesn't have Unix permissions
+	DEFAULT_PERM = 0644
+
+	// Extra field ID for the extended timestamp, which has the Unix modification time
+	EXTRA_EXTENDED_TIMESTAMP = 0x5455
+
+	// Extra field IDs for Info-ZIP's Unix fields, which have the owner's UID and GID.
+	// The old one has 16-bit IDs (after the access and modification times, and only in
+	// local headers), and the new one has IDs of any size.
+	EXTRA_UNIX_OLD = 0x5855
+	EXTRA_UNIX_NEW = 0x7875
+
+	// Extra field ID for Zip64's 64-bit sizes and offset, which are used when a field in
+	// the header is all ones
+	EXTRA_ZIP64 = 0x0001
+
+	// Extra field ID for WinZip AES encryption, and its vendor versions. AE-1 files have
+	// a CRC, and AE-2 files store 0 instead.
+	EXTRA_AES = 0x9901
+	AE_1      = 1
+	AE_2      = 2
+
+	// WinZip AES key derivation iterations, and lengths of the password verifier and
+	// authentication code
+	AES_ITERATIONS    = 1000
+	AES_VERIFIER_LEN  = 2
+	AES_AUTH_CODE_LEN = 10
 )
 
+// ErrFileNotFound is returned when the archive doesn't have the requested file.
+var ErrFileNotFound = errors.New("file not found")
+
+// ErrDuplicateName is returned when the archive already has a file with the given name.
+var ErrDuplicateName = errors.New("file already exists")
+
+// ErrReadOnly is returned when writing with an archive that has no file system, such
+// as one from NewReader.
+var ErrReadOnly = errors.New("archive is read-only")
+
+// ErrInsecurePath is returned when extracting a file whose name would put it outside
+// the destination directory, such as an absolute path or one containing "..".
+var ErrInsecurePath = errors.New("insecure file path")
+
+// ErrEncrypted is returned when reading a file whose data is encrypted.
+var ErrEncrypted = errors.New("entry is encrypted")
+
+// ErrBadPassword is returned when reading a WinZip AES file with the wrong password.
+var ErrBadPassword = errors.New("wrong password")
+
+// ErrTooLarge is returned when extracting a file would go over a limit from
+// ExtractOptions.
+var ErrTooLarge = errors.New("file is too large to extract")
+
+// ErrZip64 is returned when opening a Zip64 archive, whose sizes, offsets, or number of
+// entries don't fit in the original format's fields.
+var ErrZip64 = errors.New("Zip64 archive; not supported")
+
+// ErrMultiDisk is returned when opening one part of an archive that's split across
+// several files (like a .z01, .z02, ..., .zip set).
+var ErrMultiDisk = errors.New("multi-disk (split) archive; not supported")
+
+// ErrUnsupportedMethod is returned when reading a file whose compression method isn't
+// supported.
+var ErrUnsupportedMethod = errors.New("unsupported compression method")
+
+// ErrFileChanged is returned when a file that was added to the archive changes before
+// the archive is written, so its data no longer matches the CRC and size taken when it
+// was added.
+var ErrFileChanged = errors.New("file changed after it was added")
+
 type ZipError struct {
 	Operation string
 	Err       error
@@ -52,6 +316,12 @@ func (e *ZipError) Error() string {
 	return fmt.Sprintf("%s: %s", e.Operation, e.Err.Error())
 }
 
+// Unwrap returns the underlying error, so that errors.Is and errors.As see through
+// the ZipError.
+func (e *ZipError) Unwrap() error {
+	return e.Err
+}
+
 func newZipError(operation string, err error) *ZipError {
 	return &ZipError{Operation: operation, Err: err}
 }
@@ -59,24 +329,115 @@ func newZipErrorStr(operation string, errStr string) *ZipError {
 	return &ZipError{Operation: operation, Err: errors.New(errStr)}
 }
 
-func dosToTime(dosDate uint16, dosTime uint16) time.Time {
-	sec := dosTime & 0x1f
+// decodeText decodes a file name or comment from the archive. They're UTF-8 if the
+// file has FLAG_UTF8, and CP437 otherwise (the two agree on ASCII).
+func decodeText(b []byte, flags uint16) string {
+	if flags&FLAG_UTF8 != 0 || isASCII(string(b)) {
+		return string(b)
+	}
+	s, err := charmap.CodePage437.NewDecoder().Bytes(b)
+	if err != nil {
+		return string(b)
+	}
+	return string(s)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// setTextFields sets the lengths of fh's file name and comment as they'll be written,
+// and sets FLAG_UTF8 if either isn't ASCII, so that other tools don't read them as CP437.
+func (fh *fileHeader) setTextFields() error {
+	if len(fh.fileName) > math.MaxUint16 {
+		return errors.New("file name is longer than 65535 bytes")
+	}
+	if len(fh.comment) > math.MaxUint16 {
+		return errors.New("comment is longer than 65535 bytes")
+	}
+	fh.nameLength = uint16(len(fh.fileName))
+	fh.commentLength = uint16(len(fh.comment))
+	if !isASCII(fh.fileName) || !isASCII(fh.comment) {
+		fh.flags |= FLAG_UTF8
+	}
+	return nil
+}
+
+// fileMode returns the mode of the file: a directory for directory entries, a
+// symlink for symlink entries, and its permissions otherwise.
+func (fh *fileHeader) fileMode() os.FileMode {
+	if strings.HasSuffix(fh.fileName, "/") {
+		if fh.versionMadeBy>>8 == HOST_UNIX && fh.externalAttr>>16&0777 != 0 {
+			return os.ModeDir | fh.permissions()
+		}
+		return os.ModeDir | 0755
+	}
+	if fh.isSymlink() {
+		return os.ModeSymlink | fh.permissions()
+	}
+	return fh.permissions()
+}
+
+// isSymlink returns whether the file is a symlink, whose data is the link's target.
+// Only archives made on Unix have symlinks, marked by the file type in the Unix mode.
+func (fh *fileHeader) isSymlink() bool {
+	return fh.versionMadeBy>>8 == HOST_UNIX && fh.externalAttr>>16&S_IFMT == S_IFLNK
+}
+
+// permissions returns the permissions to give the file when it's extracted. They come
+// from the Unix mode in the external attributes if the archive was made on Unix;
+// otherwise we use a default, honoring the MS-DOS read-only attribute.
+func (fh *fileHeader) permissions() os.FileMode {
+	if fh.versionMadeBy>>8 == HOST_UNIX {
+		perm := os.FileMode(fh.externalAttr>>16) & os.ModePerm
+		if perm != 0 {
+			return perm
+		}
+	}
+	if fh.externalAttr&EXTERNAL_ATTR_READONLY != 0 {
+		return DEFAULT_PERM &^ 0222
+	}
+	return DEFAULT_PERM
+}
+
+// setUnixMode stores the Unix file type and permissions in the file's external
+// attributes, and marks the file as made on Unix so that readers use them. The MS-DOS
+// attributes in the low byte are kept.
+func (fh *fileHeader) setUnixMode(fileType uint32, perm os.FileMode) {
+	fh.versionMadeBy = HOST_UNIX<<8 | fh.versionMadeBy&0xff
+	fh.externalAttr = (fileType|uint32(perm.Perm()))<<16 | fh.externalAttr&0xffff
+	if perm&0222 == 0 {
+		fh.externalAttr |= EXTERNAL_ATTR_READONLY
+	}
+}
+
+// dosToTime converts a DOS date and time, taken to be in the time zone loc, to a
+// time.Time.
+func dosToTime(dosDate uint16, dosTime uint16, loc *time.Location) time.Time {
+	sec := (dosTime & 0x1f) * 2 // DOS times store seconds/2
 	min := (dosTime >> 5) & 0x3f
 	hr := (dosTime >> 11) & 0x1f
 	day := dosDate & 0x1f
 	month := (dosDate >> 5) & 0xf
 	year := (dosDate >> 9) & 0x7f
 
-	return time.Date(int(year)+1980, time.Month(month), int(day), int(hr), int(min), int(sec), 0, time.Local)
+	return time.Date(int(year)+1980, time.Month(month), int(day), int(hr), int(min), int(sec), 0, loc)
 }
 
+// timeToDosDateTime converts t to a DOS date and time in t's time zone. Use t.In to
+// convert it to another time zone first.
 func timeToDosDateTime(t time.Time) (uint16, uint16) {
 	year := uint16(t.Year() - 1980)
 	month := uint16(t.Month())
 	day := uint16(t.Day())
 	hr := uint16(t.Hour())
 	min := uint16(t.Minute())
-	sec := uint16(t.Second())
+	sec := uint16(t.Second() / 2) // DOS times only have 2-second resolution
 
 	dosDate := uint16(year<<9 | month<<5 | day)
 	dosTime := uint16(hr<<11 | min<<5 | sec)
@@ -84,173 +445,592 @@ func timeToDosDateTime(t time.Time) (uint16, uint16) {
 	return dosDate, dosTime
 }
 
-func (fh *fileHeader) getDateTime() time.Time {
-	return dosToTime(fh.dosDate, fh.dosTime)
+// getDateTime returns the file's modification time in the time zone loc. The time
+// comes from the extended timestamp extra field if the file has one, since that's
+// more accurate; otherwise it comes from the DOS date and time, taken to be in loc.
+func (fh *fileHeader) getDateTime(loc *time.Location) time.Time {
+	modTime, ok := fh.extendedModTime()
+	if ok {
+		return modTime.In(loc)
+	}
+	return dosToTime(fh.dosDate, fh.dosTime, loc)
 }
 
-// Make a a temp file name for the given fileName. Keep this code in one place
-// for the sake of keeping it standard.
-func tempName(fileName string) string {
-	return fmt.Sprintf("%s.tmp", fileName)
+// extraField returns the data of the field in the extra field extra with the given ID.
+func extraField(extra []byte, id uint16) ([]byte, bool) {
+	for len(extra) >= 4 {
+		fieldID := binary.LittleEndian.Uint16(extra[0:2])
+		size := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+size {
+			break // malformed, so ignore the rest
+		}
+		if fieldID == id {
+			return extra[4 : 4+size], true
+		}
+		extra = extra[4+size:]
+	}
+	return nil, false
 }
 
-func (zf *File) closeAndDeleteTempFile(file afero.File, name string) error {
-	err := file.Close()
+// extendedModTime returns the modification time from the file's extended timestamp
+// extra field, if it has one.
+func (fh *fileHeader) extendedModTime() (time.Time, bool) {
+	data, ok := extraField(fh.extra, EXTRA_EXTENDED_TIMESTAMP)
+	if !ok || len(data) < 5 || data[0]&0x1 == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(int32(binary.LittleEndian.Uint32(data[1:5]))), 0), true
+}
+
+// owner returns the UID and GID of the file's owner from its Unix extra field, if it
+// has one. The old Unix field's owner comes from the local header, which isn't read
+// when the archive is opened lazily.
+func (fh *fileHeader) owner() (int, int, bool) {
+	data, ok := extraField(fh.extra, EXTRA_UNIX_NEW)
+	if ok && len(data) >= 2 && data[0] == 1 { // version 1 is the only one
+		uidEnd := 2 + int(data[1])
+		if len(data) > uidEnd {
+			gidEnd := uidEnd + 1 + int(data[uidEnd])
+			uid, uidOk := uintLE(data[2:uidEnd])
+			if len(data) >= gidEnd {
+				gid, gidOk := uintLE(data[uidEnd+1 : gidEnd])
+				if uidOk && gidOk {
+					return int(uid), int(gid), true
+				}
+			}
+		}
+	}
+	if len(fh.localOwner) == 4 {
+		return int(binary.LittleEndian.Uint16(fh.localOwner[0:2])), int(binary.LittleEndian.Uint16(fh.localOwner[2:4])), true
+	}
+	return 0, 0, false
+}
+
+// uintLE decodes a little-endian unsigned integer of up to 4 bytes.
+func uintLE(b []byte) (uint32, bool) {
+	if len(b) == 0 || len(b) > 4 {
+		return 0, false
+	}
+	var n uint32
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint32(b[i])
+	}
+	return n, true
+}
+
+// keptExtra returns the extra field to write for the file when the archive is
+// rewritten. Only the modification time from the extended timestamp field, the new
+// Unix field (or the owner from the old one), and the WinZip AES field (without which
+// the file can't be decrypted) are kept; other fields are dropped, since they could be
+// wrong for the rewritten file.
+func (fh *fileHeader) keptExtra() []byte {
+	var extra []byte
+	modTime, ok := fh.extendedModTime()
+	if ok {
+		extra = binary.LittleEndian.AppendUint16(extra, EXTRA_EXTENDED_TIMESTAMP)
+		extra = binary.LittleEndian.AppendUint16(extra, 5)
+		extra = append(extra, 0x1) // only the modification time is present
+		extra = binary.LittleEndian.AppendUint32(extra, uint32(modTime.Unix()))
+	}
+	for _, id := range []uint16{EXTRA_UNIX_NEW, EXTRA_AES} {
+		data, ok := extraField(fh.extra, id)
+		if ok {
+			extra = binary.LittleEndian.AppendUint16(extra, id)
+			extra = binary.LittleEndian.AppendUint16(extra, uint16(len(data)))
+			extra = append(extra, data...)
+		}
+	}
+	_, hasNew := extraField(fh.extra, EXTRA_UNIX_NEW)
+	if !hasNew && len(fh.localOwner) == 4 {
+		// Keep an owner from the old Unix field as a new Unix field
+		extra = binary.LittleEndian.AppendUint16(extra, EXTRA_UNIX_NEW)
+		extra = binary.LittleEndian.AppendUint16(extra, 7)
+		extra = append(extra, 1, 2, fh.localOwner[0], fh.localOwner[1], 2, fh.localOwner[2], fh.localOwner[3])
+	}
+	return extra
+}
+
+// entryName returns the name to store a file that's added with the given name: with
+// "/" as the separator, without a leading "./", "/", or volume name, and without
+// redundant separators or elements. A trailing "/" (for a directory) is kept. It
+// returns ErrInsecurePath if the name would be outside the archive's root.
+func entryName(name string) (string, error) {
+	slashed := filepath.ToSlash(strings.TrimPrefix(name, filepath.VolumeName(name)))
+	cleaned := strings.TrimLeft(path.Clean(slashed), "/")
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: %q", ErrInsecurePath, name)
+	}
+	if cleaned == "." || cleaned == "" {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	if strings.HasSuffix(slashed, "/") {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
+
+// extractPath returns the path that the file with the given name in the archive is
+// extracted to in the directory dir. It returns ErrInsecurePath if the file would end
+// up outside dir.
+func extractPath(dir string, name string) (string, error) {
+	local := filepath.FromSlash(name)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%w: %q", ErrInsecurePath, name)
+	}
+	return filepath.Join(dir, local), nil
+}
+
+// createTempFile creates a temp file next to fileName, to be renamed to fileName once
+// it's written, and returns it with its name. The name is unique (like
+// "fileName.123456.tmp"), so operations on the same file at the same time don't use
+// each other's temp files. Only the owner can read or write the temp file.
+func createTempFile(fs afero.Fs, fileName string) (afero.File, string, error) {
+	file, err := afero.TempFile(fs, filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	return file, file.Name(), nil
+}
+
+// createArchiveTempFile is like createTempFile, but the temp file gets the archive's
+// permissions (or 0644 for a new archive), since it's a new copy of the archive.
+func (zf *File) createArchiveTempFile(fileName string) (afero.File, string, error) {
+	file, name, err := createTempFile(zf.fs, fileName)
+	if err != nil {
+		return nil, "", err
 	}
-	return zf.fs.Remove(name)
+	perm := os.FileMode(0644)
+	info, err := zf.fs.Stat(zf.Name)
+	if err == nil {
+		perm = info.Mode().Perm()
+	}
+	err = zf.fs.Chmod(name, perm)
+	if err != nil {
+		closeAndDeleteTempFile(zf.fs, file, name)
+		return nil, "", err
+	}
+	return file, name, nil
 }
 
-func (zf *File) closeAndRenameTempFile(file afero.File, tempName string, name string) error {
+func closeAndDeleteTempFile(fs afero.Fs, file afero.File, name string) error {
 	err := file.Close()
 	if err != nil {
 		return err
 	}
-	return zf.fs.Rename(tempName, name) // Will replace any file with the same name!
+	return fs.Remove(name)
 }
 
-func checkCrc(crc uint32, file afero.File) (bool, error) {
-	fileCrc, err := getCrc(file)
+func closeAndRenameTempFile(fs afero.Fs, file afero.File, tempName string, name string) error {
+	err := file.Close()
 	if err != nil {
-		return false, err
+		return err
 	}
-	return crc == fileCrc, nil
+	return fs.Rename(tempName, name) // Will replace any file with the same name!
 }
 
-func getCrc(file afero.File) (uint32, error) {
-	// TODO there's surely a better way to do this beside reading the whole file into memory
+// getCrc returns the CRC of the file's contents, and whether they look like text (see
+// textDetector).
+func getCrc(file afero.File) (uint32, bool, error) {
 	_, err := file.Seek(0, io.SeekStart)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
-	info, err := file.Stat()
+	hash := crc32.NewIEEE()
+	text := &textDetector{}
+	_, err = io.Copy(io.MultiWriter(hash, text), file)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
-	data := make([]byte, info.Size())
-	_, err = file.Read(data)
-	if err != nil {
-		return 0, err
+	return hash.Sum32(), text.isText(), nil
+}
+
+// textDetector is an io.Writer that guesses whether the data written to it is text,
+// for the internal attributes' text bit. Data is text if it isn't empty and has no
+// control characters other than whitespace, escape, and the DOS end-of-file mark.
+type textDetector struct {
+	written bool
+	binary  bool
+}
+
+func (td *textDetector) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		td.written = true
+	}
+	for _, c := range p {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\v' && c != '\f' && c != '\r' && c != 0x1a && c != 0x1b {
+			td.binary = true
+			break
+		}
 	}
-	return crc32.ChecksumIEEE(data), nil
+	return len(p), nil
 }
 
-// Writes the zip archive to the temporary new zip file.
-// Assumes that zf.fileHeaders has the correct headers in it, but fields related to
-// offsets and the size of the central directory are incorrect.
-// newFh and newData represent a new file to be added to the archive. If they're not nil,
-// then they will be added.
-func (zf *File) writeArchive(outfile afero.File, newFh *fileHeader, newData io.ReadSeeker) error {
-	_, err := outfile.Seek(0, io.SeekStart)
+// isText returns whether the data written so far is text.
+func (td *textDetector) isText() bool {
+	return td.written && !td.binary
+}
+
+// textAttr returns the internal attributes for a file whose data is text if text is
+// true.
+func textAttr(text bool) uint16 {
+	if text {
+		return INTERNAL_ATTR | INTERNAL_ATTR_TEXT
+	}
+	return INTERNAL_ATTR
+}
+
+// changeReader reads a new file's data for writing it to the archive, and returns
+// ErrFileChanged if the data doesn't match the CRC and uncompressed size in its header.
+type changeReader struct {
+	r   io.Reader
+	fh  *fileHeader
+	n   int64 // bytes read so far
+	crc hash.Hash32
+}
+
+func (cr *changeReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	cr.crc.Write(p[:n])
+	if cr.n > int64(cr.fh.uncompressedSize) || (err == io.EOF && (cr.n != int64(cr.fh.uncompressedSize) || cr.crc.Sum32() != cr.fh.crc)) {
+		return n, fmt.Errorf("%w: %s", ErrFileChanged, cr.fh.fileName)
+	}
+	return n, err
+}
+
+// ratioLimit returns the most bytes that a file with the given compressed size can
+// decompress to with the given ratio, capped at math.MaxInt64 instead of overflowing.
+func ratioLimit(compressedSize uint32, ratio int64) int64 {
+	if compressedSize != 0 && ratio > math.MaxInt64/int64(compressedSize) {
+		return math.MaxInt64
+	}
+	return int64(compressedSize) * ratio
+}
+
+// limitReader is like io.LimitedReader, but reading more than n bytes returns err
+// instead of stopping at n bytes.
+type limitReader struct {
+	r   io.Reader
+	n   int64 // bytes left to read
+	err error
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.n < math.MaxInt64 && int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1] // one more byte than allowed shows whether there's too much
+	}
+	n, err := lr.r.Read(p)
+	if int64(n) > lr.n {
+		return int(lr.n), lr.err
+	}
+	lr.n -= int64(n)
+	return n, err
+}
+
+// lockedReaderAt is an io.ReaderAt that only does one read at a time. Some afero files
+// (like MemMapFs's) implement ReadAt by moving the file's position, so parallel reads
+// would read from each other's offsets.
+type lockedReaderAt struct {
+	mu sync.Mutex
+	r  io.ReaderAt
+}
+
+func (lr *lockedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.ReadAt(p, off)
+}
+
+// contextReader is an io.Reader that stops with ctx's error once ctx is done, so that
+// long copies can be cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	err := cr.ctx.Err()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	return cr.r.Read(p)
+}
+
+// progressWriter is an io.Writer that calls progress with the number of bytes in each
+// write.
+type progressWriter struct {
+	w        io.Writer
+	progress func(n int64)
+}
 
-	if newFh != nil {
-		zf.fileHeaders = append(zf.fileHeaders, *newFh)
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.progress(int64(n))
+	return n, err
+}
+
+// countingWriter is an io.Writer that counts the bytes written to it, so that we know
+// offsets without seeking.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Writes the zip archive to w, and returns the file headers as they were written, with
+// updated offsets, along with the central directory's offset and size. w doesn't need
+// to be seekable.
+// headers are the file headers to write; fields related to offsets are incorrect. Headers
+// with a source are new files, whose data is read from the source rather than from zf.r.
+// If dataDescriptors is true, each file's CRC and sizes go in a data descriptor after its
+// data instead of in its local header, like a zip archive written as a stream.
+func (zf *File) writeArchive(ctx context.Context, w io.Writer, headers []fileHeader, dataDescriptors bool) ([]fileHeader, uint32, uint32, error) {
+	headers = slices.Clone(headers)
+	cw := &countingWriter{w: w}
+
+	// Keep anything before the zip data, like a self-extracting stub
+	if zf.stubLength > 0 {
+		_, err := io.Copy(cw, io.NewSectionReader(zf.r, 0, zf.stubLength))
+		if err != nil {
+			return nil, 0, 0, err
+		}
 	}
 
 	// Write local file headers and file data
-	for i, fh := range zf.fileHeaders {
+	for i, fh := range headers {
+		err := ctx.Err()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
 		// Get the data for this header's file BEFORE we change anything about the header
 		var fileData io.Reader
-		if newFh == nil || i < len(zf.fileHeaders)-1 {
-			fileDataOffset := fh.offsetLocalHeader + 30 + uint32(fh.nameLength) + uint32(fh.extraLengthLocal)
-			zf.file.Seek(int64(fileDataOffset), io.SeekStart)
-			fileData = io.LimitReader(zf.file, int64(fh.compressedSize))
-		} else { // Last file, which is the new file, since newFh != nil
-			newData.Seek(0, io.SeekStart)
-			fileData = newData
+		var closer io.Closer
+		if fh.source == nil {
+			fileData, err = zf.rawFileData(&fh)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+		} else {
+			data, err := fh.source()
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			fileData = data
+			closer = data
+			if !fh.raw {
+				// The CRC and size were taken when the file was added, so make sure the
+				// data still matches them
+				fileData = &changeReader{r: data, fh: &headers[i], crc: crc32.NewIEEE()}
+			}
+			if fh.compressionMethod == COMPRESS_DEFLATED && !fh.raw {
+				// The compressed size has to be known before the local header is written
+				compressed, err := deflateData(ctx, fileData, fh.level)
+				data.Close()
+				closer = nil
+				if err != nil {
+					return nil, 0, 0, err
+				}
+				if len(compressed) > math.MaxUint32 {
+					return nil, 0, 0, errors.New("file is too large")
+				}
+				fileData = bytes.NewReader(compressed)
+				headers[i].compressedSize = uint32(len(compressed))
+			}
 		}
 
-		// Update the file header struct: offset and extra length
-		offset, err := outfile.Seek(0, io.SeekCurrent)
+		// Update the file header struct: offset and extra field, which only keeps the
+		// fields we know are still right after the file is rewritten
+		if cw.n > math.MaxUint32 {
+			return nil, 0, 0, errors.New("archive is too large")
+		}
+		headers[i].offsetLocalHeader = uint32(cw.n)
+		headers[i].extra = headers[i].keptExtra()
+		headers[i].extraLengthLocal = uint16(len(headers[i].extra))
+		headers[i].extraLengthCentral = uint16(len(headers[i].extra))
+		err = headers[i].setTextFields()
 		if err != nil {
-			return err
+			if closer != nil {
+				closer.Close()
+			}
+			return nil, 0, 0, err
+		}
+		localHeader := headers[i]
+		if dataDescriptors {
+			// The CRC and sizes are zero in the local header and follow the data instead
+			headers[i].flags |= FLAG_DATA_DESCRIPTOR
+			localHeader.flags = headers[i].flags
+			localHeader.crc = 0
+			localHeader.compressedSize = 0
+			localHeader.uncompressedSize = 0
+		} else {
+			// The sizes and CRC go in the local header, so there's no data descriptor
+			headers[i].flags &^= FLAG_DATA_DESCRIPTOR
+			localHeader.flags = headers[i].flags
+		}
+
+		err = writeLocalHeader(cw, &localHeader)
+		if err == nil {
+			_, err = io.Copy(cw, &contextReader{ctx: ctx, r: fileData})
+		}
+		if closer != nil {
+			closer.Close()
+		}
+		if err == nil && dataDescriptors {
+			err = writeDataDescriptor(cw, &headers[i])
 		}
-		zf.fileHeaders[i].offsetLocalHeader = uint32(offset)
-		zf.fileHeaders[i].extraLengthLocal = 0
-
-		binary.Write(outfile, binary.LittleEndian, []byte("\x50\x4b\x03\x04"))
-		binary.Write(outfile, binary.LittleEndian, fh.versionNeeded)
-		binary.Write(outfile, binary.LittleEndian, fh.flags)
-		binary.Write(outfile, binary.LittleEndian, fh.compressionMethod)
-		binary.Write(outfile, binary.LittleEndian, fh.dosTime)
-		binary.Write(outfile, binary.LittleEndian, fh.dosDate)
-		binary.Write(outfile, binary.LittleEndian, fh.crc)
-		binary.Write(outfile, binary.LittleEndian, fh.compressedSize)
-		binary.Write(outfile, binary.LittleEndian, fh.uncompressedSize)
-		binary.Write(outfile, binary.LittleEndian, fh.nameLength)
-		binary.Write(outfile, binary.LittleEndian, []byte("\x00\x00")) // extra field length
-		binary.Write(outfile, binary.LittleEndian, []byte(fh.fileName))
-		// Extra field goes after file name, but we're not keeping extra fields
-		_, err = io.Copy(outfile, fileData)
 		if err != nil {
-			return err
+			return nil, 0, 0, err
 		}
+		headers[i].source = nil // The file's data is in the archive now
+		headers[i].raw = false
+	}
+
+	// Write central directory
+	centralDirOffset := cw.n
+	for i := range headers {
+		err := writeCentralDirHeader(cw, &headers[i])
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	centralDirSize := cw.n - centralDirOffset
+	if centralDirOffset > math.MaxUint32 || centralDirSize > math.MaxUint32 {
+		return nil, 0, 0, errors.New("archive is too large")
 	}
 
-	// Update central directory offset and write central directory
-	offset, err := outfile.Seek(0, io.SeekCurrent)
+	// Write the end-of-central-directory record
+	err := writeEndOfCentralDir(cw, uint16(len(headers)), uint32(centralDirSize), uint32(centralDirOffset), zf.comment)
 	if err != nil {
-		return err
+		return nil, 0, 0, err
 	}
-	zf.centralDirOffset = uint32(offset)
-
-	for i, fh := range zf.fileHeaders {
-		errs := []error{}
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, []byte("\x50\x4b\x01\x02")))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.versionMadeBy))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.versionNeeded))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.flags))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.compressionMethod))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.dosTime))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.dosDate))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.crc))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.compressedSize))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.uncompressedSize))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.nameLength))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, []byte("\x00\x00"))) // extra field length
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.commentLength))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, uint16(0))) // disk # start
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.internalAttr))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.externalAttr))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, fh.offsetLocalHeader))
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, []byte(fh.fileName)))
-		// Extra field goes after file name, but we're not keeping extra fields
-		errs = append(errs, binary.Write(outfile, binary.LittleEndian, []byte(fh.comment)))
-		for _, err := range errs {
-			if err != nil {
-				return err
-			}
-		}
-		zf.fileHeaders[i].extraLengthCentral = 0 // We threw out the extra field as we wrote the central directory
+
+	return headers, uint32(centralDirOffset), uint32(centralDirSize), nil
+}
+
+// deflateData returns the data read from r compressed with deflate at the given
+// level, which is one of compress/flate's levels. It stops with ctx's error if ctx is
+// done while the data is being compressed.
+func deflateData(ctx context.Context, r io.Reader, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(w, &contextReader{ctx: ctx, r: r})
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	// Update central directory size
-	offset, err = outfile.Seek(0, io.SeekCurrent)
+// rawFileData returns a reader for the data of the file with the given header, as it's
+// stored in the archive (without decompressing it).
+func (zf *File) rawFileData(fh *fileHeader) (io.Reader, error) {
+	offset, err := zf.dataOffset(fh)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	zf.centralDirSize = uint32(offset) - zf.centralDirOffset
+	return io.NewSectionReader(zf.r, offset, int64(fh.compressedSize)), nil
+}
 
-	// Write the end-of-central-directory record
-	errs := []error{}
-	errs = append(errs, binary.Write(outfile, binary.LittleEndian, []byte("\x50\x4b\x05\x06")))
-	errs = append(errs, binary.Write(outfile, binary.LittleEndian, uint16(0)))     // disk # start
-	errs = append(errs, binary.Write(outfile, binary.LittleEndian, uint16(0)))     // disk # of cd
-	errs = append(errs, binary.Write(outfile, binary.LittleEndian, zf.numEntries)) // entires on this disk
-	errs = append(errs, binary.Write(outfile, binary.LittleEndian, zf.numEntries)) // total entries
-	errs = append(errs, binary.Write(outfile, binary.LittleEndian, zf.centralDirSize))
-	errs = append(errs, binary.Write(outfile, binary.LittleEndian, zf.centralDirOffset))
-	errs = append(errs, binary.Write(outfile, binary.LittleEndian, zf.commentLength))
-	errs = append(errs, binary.Write(outfile, binary.LittleEndian, zf.comment))
-	for _, err := range errs {
+// dataOffset returns the offset of the file data for the given header, which comes
+// after the local header, file name, and local extra field. The local extra field's
+// length is found when the directory is read, unless the archive was opened lazily. It
+// returns an error if the data would run past the end of the archive.
+func (zf *File) dataOffset(fh *fileHeader) (int64, error) {
+	extraLength := fh.extraLengthLocal
+	if zf.lazy {
+		var err error
+		extraLength, err = zf.readLocalHeader(fh)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
+	offset := int64(fh.offsetLocalHeader) + 30 + int64(fh.nameLength) + int64(extraLength)
+	if offset+int64(fh.compressedSize) > zf.size {
+		return 0, fmt.Errorf("entry data extends past end of archive (%s)", fh.fileName)
+	}
+	return offset, nil
+}
 
-	return nil
+// writeLocalHeader writes the local file header for fh, with fh.extra as its extra
+// field.
+func writeLocalHeader(w io.Writer, fh *fileHeader) error {
+	errs := []error{}
+	errs = append(errs, binary.Write(w, binary.LittleEndian, []byte("\x50\x4b\x03\x04")))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.versionNeeded))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.flags))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.compressionMethod))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.dosTime))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.dosDate))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.crc))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.compressedSize))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.uncompressedSize))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.nameLength))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, uint16(len(fh.extra))))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, []byte(fh.fileName)))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.extra))
+	return errors.Join(errs...)
+}
+
+// writeDataDescriptor writes the data descriptor that follows fh's data when
+// FLAG_DATA_DESCRIPTOR is set.
+func writeDataDescriptor(w io.Writer, fh *fileHeader) error {
+	errs := []error{}
+	errs = append(errs, binary.Write(w, binary.LittleEndian, []byte("\x50\x4b\x07\x08")))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.crc))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.compressedSize))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.uncompressedSize))
+	return errors.Join(errs...)
+}
+
+// writeCentralDirHeader writes the central directory file header for fh, with
+// fh.extra as its extra field.
+func writeCentralDirHeader(w io.Writer, fh *fileHeader) error {
+	errs := []error{}
+	errs = append(errs, binary.Write(w, binary.LittleEndian, []byte("\x50\x4b\x01\x02")))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.versionMadeBy))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.versionNeeded))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.flags))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.compressionMethod))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.dosTime))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.dosDate))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.crc))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.compressedSize))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.uncompressedSize))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.nameLength))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, uint16(len(fh.extra))))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.commentLength))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, uint16(0))) // disk # start
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.internalAttr))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.externalAttr))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.offsetLocalHeader))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, []byte(fh.fileName)))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, fh.extra))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, []byte(fh.comment)))
+	return errors.Join(errs...)
+}
+
+// writeEndOfCentralDir writes the end-of-central-directory record.
+func writeEndOfCentralDir(w io.Writer, numEntries uint16, centralDirSize uint32, centralDirOffset uint32, comment []byte) error {
+	errs := []error{}
+	errs = append(errs, binary.Write(w, binary.LittleEndian, []byte("\x50\x4b\x05\x06")))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, uint16(0)))  // disk # start
+	errs = append(errs, binary.Write(w, binary.LittleEndian, uint16(0)))  // disk # of cd
+	errs = append(errs, binary.Write(w, binary.LittleEndian, numEntries)) // entires on this disk
+	errs = append(errs, binary.Write(w, binary.LittleEndian, numEntries)) // total entries
+	errs = append(errs, binary.Write(w, binary.LittleEndian, centralDirSize))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, centralDirOffset))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, uint16(len(comment))))
+	errs = append(errs, binary.Write(w, binary.LittleEndian, comment))
+	return errors.Join(errs...)
 }